@@ -0,0 +1,61 @@
+package profiler
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Backend is the implementation collecting the profiles and uploading them to
+// the agent. See WithBackend.
+type Backend int
+
+const (
+	// NativeBackend collects the profiles with runtime/pprof.
+	NativeBackend Backend = iota
+	// DataDogBackend hands collection and upload to the DataDog profiler. It
+	// is not available when building with the nodatadog tag.
+	DataDogBackend
+)
+
+func (b Backend) String() string {
+	switch b {
+	case NativeBackend:
+		return "native"
+	case DataDogBackend:
+		return "datadog"
+	default:
+		return fmt.Sprintf("invalid backend (%d)", int(b))
+	}
+}
+
+// parseBackend returns the backend named name, as returned by String.
+func parseBackend(name string) (Backend, bool) {
+	switch name {
+	case "native":
+		return NativeBackend, true
+	case "datadog":
+		return DataDogBackend, true
+	default:
+		return 0, false
+	}
+}
+
+// backend collects the profiles and exports them. Only one
+// backend collects at a time.
+type backend interface {
+	// start starts collecting the profiles described by cfg. At the end of
+	// each period, they are handed to exporter, or uploaded to agentAddr
+	// with client by the backends that can only use HTTP.
+	start(cfg *config, agentAddr string, client *http.Client, exporter Exporter) error
+	// stop stops collecting. The profiles of the current, partial, period
+	// are collected and uploaded before it returns.
+	stop()
+}
+
+// newBackend returns the implementation of b.
+func newBackend(b Backend) backend {
+	if b == DataDogBackend {
+		return newDataDogBackend()
+	}
+	return &nativeBackend{}
+}
@@ -0,0 +1,140 @@
+//go:build !nodatadog
+
+package profiler
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/rs/zerolog"
+
+	dd_trace "github.com/DataDog/dd-trace-go/v2/ddtrace/tracer"
+	dd_profiler "github.com/DataDog/dd-trace-go/v2/profiler"
+)
+
+// hasDataDogBackend reports whether DataDogBackend can be used.
+const hasDataDogBackend = true
+
+// ddEnv is the environment of the DataDog profiler, set when it first starts
+// so that the native backend leaves the environment alone. The bootstrap
+// package sets it at import instead, along with the settings the DataDog
+// profiler reads at initialization.
+var (
+	ddEnv = map[string]string{
+		// Disable sending telemetry data
+		"DD_INSTRUMENTATION_TELEMETRY_ENABLED": "false",
+		// Collect and upload the profiles of the last period when stopping,
+		// so that Stop can flush them
+		"DD_PROFILING_FLUSH_ON_EXIT": "true",
+	}
+	ddEnvOnce sync.Once
+)
+
+// datadogBackend hands collection and upload to the DataDog profiler, which
+// is process wide.
+type datadogBackend struct{}
+
+func newDataDogBackend() backend {
+	return datadogBackend{}
+}
+
+func (datadogBackend) start(cfg *config, agentAddr string, client *http.Client, exporter Exporter) error {
+	ddEnvOnce.Do(func() {
+		for name, value := range ddEnv {
+			os.Setenv(name, value)
+		}
+	})
+	client = &http.Client{Transport: finalAttemptTransport{client.Transport}, Timeout: client.Timeout}
+	return dd_profiler.Start(ddOptions(cfg, agentAddr, client)...)
+}
+
+// finalAttemptTransport keeps the DataDog profiler from retrying the uploads
+// on top of the retries of bfTransport, so that a batch is uploaded within
+// the upload timeout: it logs the failures the DataDog profiler would retry,
+// and answers them with a 204 response.
+type finalAttemptTransport struct {
+	Transport http.RoundTripper
+}
+
+func (t finalAttemptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	response, err := t.Transport.RoundTrip(req)
+	if err == nil && response.StatusCode < 500 {
+		return response, nil
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to upload profile")
+	} else {
+		log.Error().Int("status", response.StatusCode).Msg("failed to upload profile")
+		if response.Body != nil {
+			response.Body.Close()
+		}
+	}
+	return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+}
+
+func (datadogBackend) stop() {
+	dd_profiler.Stop()
+}
+
+// setBackendLogger sends the logs of the DataDog profiler to logger.
+func setBackendLogger(logger zerolog.Logger) {
+	dd_trace.UseLogger(NewDataDogLoggerBridge(logger))
+}
+
+// ddOptions returns the options of the DataDog profiler for cfg.
+func ddOptions(cfg *config, agentAddr string, httpClient *http.Client) []dd_profiler.Option {
+	mapLabelsToTags := func(m map[string]string) []string {
+		tags := make([]string, 0, len(m))
+		for k, v := range m {
+			tags = append(tags, fmt.Sprintf("%s:%s", k, v))
+		}
+		return tags
+	}
+
+	mapProfTypesToDDProfTypes := func(m []ProfileType) []dd_profiler.ProfileType {
+		dd_prof_types := make([]dd_profiler.ProfileType, 0, len(m))
+		for _, v := range m {
+			switch v {
+			case CPUProfile:
+				dd_prof_types = append(dd_prof_types, dd_profiler.CPUProfile)
+			case HeapProfile, AllocationProfile:
+				// The DataDog heap profile carries both the in-use values and
+				// the alloc_space/alloc_objects deltas over the period, unlike
+				// the delta-heap.pprof and delta-alloc.pprof profiles of the
+				// native backend.
+				if !slices.Contains(dd_prof_types, dd_profiler.HeapProfile) {
+					dd_prof_types = append(dd_prof_types, dd_profiler.HeapProfile)
+				}
+			case GoroutineProfile:
+				dd_prof_types = append(dd_prof_types, dd_profiler.GoroutineProfile)
+			case BlockProfile:
+				dd_prof_types = append(dd_prof_types, dd_profiler.BlockProfile)
+			case MutexProfile:
+				dd_prof_types = append(dd_prof_types, dd_profiler.MutexProfile)
+			default:
+			}
+		}
+		return dd_prof_types
+	}
+
+	opts := []dd_profiler.Option{
+		dd_profiler.WithAgentAddr(agentAddr),
+		dd_profiler.WithHTTPClient(httpClient),
+		dd_profiler.CPUProfileRate(cfg.cpuProfileRate),
+		dd_profiler.WithPeriod(cfg.period),
+		dd_profiler.CPUDuration(cfg.cpuDuration),
+		dd_profiler.WithTags(mapLabelsToTags(cfg.labels)...),
+		dd_profiler.WithUploadTimeout(cfg.uploadTimeout),
+		dd_profiler.WithProfileTypes(mapProfTypesToDDProfTypes(cfg.types)...),
+	}
+	if slices.Contains(cfg.types, BlockProfile) {
+		opts = append(opts, dd_profiler.BlockProfileRate(cfg.blockRate))
+	}
+	if slices.Contains(cfg.types, MutexProfile) {
+		opts = append(opts, dd_profiler.MutexProfileFraction(cfg.mutexFraction))
+	}
+	return opts
+}
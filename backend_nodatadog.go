@@ -0,0 +1,16 @@
+//go:build nodatadog
+
+package profiler
+
+import (
+	"github.com/rs/zerolog"
+)
+
+// hasDataDogBackend reports whether DataDogBackend can be used.
+const hasDataDogBackend = false
+
+func newDataDogBackend() backend {
+	return nil
+}
+
+func setBackendLogger(logger zerolog.Logger) {}
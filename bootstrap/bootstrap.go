@@ -1,3 +1,8 @@
+// Package bootstrap sets the environment of the DataDog profiler when it is
+// imported. The profiler sets it when DataDogBackend starts, but the DataDog
+// profiler reads DD_LOGGING_RATE when it is initialized: import this package
+// before the profiler to have the DataDog profiler log its errors right away
+// instead of once per minute.
 package bootstrap
 
 import (
@@ -11,4 +16,8 @@ func init() {
 	// Disable loggingrate - DD profiler only logs same error at some configurable
 	// rate by default
 	os.Setenv("DD_LOGGING_RATE", "0")
+
+	// Collect and upload the profiles of the last period when stopping, so
+	// that Stop can flush them
+	os.Setenv("DD_PROFILING_FLUSH_ON_EXIT", "true")
 }
@@ -0,0 +1,64 @@
+package profiler
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerFailures is the number of consecutive failed uploads
+	// after which profile collection is paused.
+	DefaultBreakerFailures = 5
+	// DefaultBreakerMaxCooldown is the longest pause between two probes of
+	// the agent while profile collection is paused.
+	DefaultBreakerMaxCooldown = 30 * time.Minute
+)
+
+// breaker counts the consecutive uploads that failed because the agent is
+// unreachable or too old. Once there are too many, it trips and the profiler
+// pauses collection until the agent answers a probe again.
+type breaker struct {
+	failures int // failures needed to trip
+
+	mu          sync.Mutex
+	consecutive int
+	open        bool
+	tripped     chan struct{} // receives when the breaker opens
+}
+
+func newBreaker(failures int) *breaker {
+	return &breaker{
+		failures: failures,
+		tripped:  make(chan struct{}, 1),
+	}
+}
+
+// record records the outcome of an upload. Any response from the agent,
+// except the ones telling it is too old, resets the count.
+func (b *breaker) record(r uploadResult) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r.agentAnswered() {
+		b.consecutive = 0
+		return
+	}
+
+	b.consecutive++
+	if b.consecutive >= b.failures && !b.open {
+		b.open = true
+		select {
+		case b.tripped <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// reset closes the breaker, once the agent answered a probe.
+func (b *breaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consecutive = 0
+	b.open = false
+}
@@ -1,11 +1,32 @@
 package profiler
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
+// TestMain keeps the tests from reading the Blackfire configuration file of
+// the user running them: the tests setting it up use HOME or BLACKFIRE_CONFIG
+// themselves.
+func TestMain(m *testing.M) {
+	home, err := os.MkdirTemp("", "conprof-home")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("HOME", home)
+	os.Unsetenv("BLACKFIRE_CONFIG")
+
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
 func TestConfig(t *testing.T) {
 	t.Setenv("PLATFORM_APPLICATION_NAME", "foo2")
 	t.Setenv("BLACKFIRE_CONPROF_APP_NAME", "foo")
@@ -43,3 +64,124 @@ func TestConfig(t *testing.T) {
 	require.Equal(t, "duh!", config.labels["application_name"])
 	require.Equal(t, "go", config.labels["runtime"])
 }
+
+func TestConfigValidation(t *testing.T) {
+	_, err := newProfilerConfig(WithCPUDuration(time.Second))
+	require.Nil(t, err)
+
+	_, err = newProfilerConfig(
+		WithProfileTypes(),
+		WithUploadTimeout(0),
+		WithCPUProfileRate(-1),
+		WithLabels(map[string]string{"a:b": "c", "d": "e,f"}),
+	)
+	var cerr *ConfigError
+	require.ErrorAs(t, err, &cerr)
+	require.Len(t, cerr.Errors, 5)
+	require.Contains(t, err.Error(), "no profile type enabled")
+	require.Contains(t, err.Error(), "upload timeout must be positive")
+	require.Contains(t, err.Error(), "CPU profile rate must not be negative")
+	require.Contains(t, err.Error(), `label name must not contain ':' or ',' ("a:b")`)
+	require.Contains(t, err.Error(), `label value must not contain ',' (d="e,f")`)
+
+	_, err = newProfilerConfig(WithProfileTypes(CPUProfile, ProfileType(42), MutexProfile), WithMutexProfileFraction(0))
+	require.ErrorAs(t, err, &cerr)
+	require.Len(t, cerr.Errors, 2)
+	require.Contains(t, err.Error(), "unknown profile type (42)")
+	require.Contains(t, err.Error(), "mutex profile fraction must be positive")
+
+	err = Start(WithProfileTypes(ProfileType(42)))
+	require.ErrorAs(t, err, &cerr)
+}
+
+func TestConfigEnvDurations(t *testing.T) {
+	t.Setenv("BLACKFIRE_CONPROF_CPU_DURATION", "1m30s")
+	t.Setenv("BLACKFIRE_CONPROF_PERIOD", "120")
+	t.Setenv("BLACKFIRE_CONPROF_UPLOAD_TIMEOUT", "500ms")
+
+	config, err := initDefaultConfig()
+	require.Nil(t, err)
+	require.Equal(t, 90*time.Second, config.cpuDuration)
+	require.Equal(t, 120*time.Second, config.period)
+	require.Equal(t, 500*time.Millisecond, config.uploadTimeout)
+	require.Empty(t, config.envErrors)
+}
+
+func TestConfigStrictEnv(t *testing.T) {
+	t.Setenv("BLACKFIRE_CONPROF_PERIOD", "abc")
+	t.Setenv("BLACKFIRE_CONPROF_CPU_PROFILERATE", "1.5")
+
+	// Malformed values are ignored by default
+	config, err := newProfilerConfig()
+	require.Nil(t, err)
+	require.Equal(t, defaultPeriod, config.period)
+	require.Len(t, config.envErrors, 2)
+
+	_, err = newProfilerConfig(WithStrictEnv(true))
+	var cerr *ConfigError
+	require.ErrorAs(t, err, &cerr)
+	require.Len(t, cerr.Errors, 2)
+	require.Contains(t, err.Error(), `invalid period in BLACKFIRE_CONPROF_PERIOD: "abc"`)
+	require.Contains(t, err.Error(), `invalid CPU profile rate in BLACKFIRE_CONPROF_CPU_PROFILERATE: "1.5"`)
+
+	t.Setenv("BLACKFIRE_CONPROF_STRICT", "true")
+	_, err = newProfilerConfig()
+	require.ErrorAs(t, err, &cerr)
+
+	// Options win over the environment
+	_, err = newProfilerConfig(WithStrictEnv(false))
+	require.Nil(t, err)
+}
+
+func TestConfigINI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blackfire.ini")
+	require.Nil(t, os.WriteFile(path, []byte("[blackfire]\nserver-id=ini-id\nserver-token=ini-token\nagent_socket=tcp://127.0.0.1:8307\n"), 0600))
+	t.Setenv("BLACKFIRE_CONFIG", path)
+
+	cfg, err := newProfilerConfig()
+	require.Nil(t, err)
+	require.Equal(t, "ini-id", cfg.serverId)
+	require.Equal(t, "ini-token", cfg.serverToken)
+	require.Equal(t, "tcp://127.0.0.1:8307", cfg.agentSocket)
+
+	// The environment and the options take precedence
+	t.Setenv("BLACKFIRE_SERVER_ID", "env-id")
+	t.Setenv("BLACKFIRE_AGENT_SOCKET", "tcp://127.0.0.1:8308")
+	cfg, err = newProfilerConfig(WithAgentSocket("tcp://127.0.0.1:8309"))
+	require.Nil(t, err)
+	require.Equal(t, "env-id", cfg.serverId)
+	require.Equal(t, "ini-token", cfg.serverToken)
+	require.Equal(t, "tcp://127.0.0.1:8309", cfg.agentSocket)
+
+	// A missing BLACKFIRE_CONFIG file is a configuration error
+	t.Setenv("BLACKFIRE_CONFIG", filepath.Join(t.TempDir(), "missing.ini"))
+	_, err = newProfilerConfig()
+	require.Nil(t, err)
+	_, err = newProfilerConfig(WithStrictEnv(true))
+	require.ErrorContains(t, err, "could not read Blackfire configuration file")
+}
+
+func TestConfigSampleRatio(t *testing.T) {
+	sampled := 0
+	for i := range 1000 {
+		cfg, err := newProfilerConfig(WithSampleRatio(0.2), WithLabels(map[string]string{"host": fmt.Sprintf("pod-%d", i)}))
+		require.Nil(t, err)
+		if cfg.sampled() {
+			sampled++
+		}
+		// The decision is the same on every start
+		require.Equal(t, cfg.sampled(), cfg.sampled())
+	}
+	require.InDelta(t, 200, sampled, 50)
+
+	cfg, err := newProfilerConfig(WithSampleRatio(0))
+	require.Nil(t, err)
+	require.False(t, cfg.sampled())
+	cfg, err = newProfilerConfig()
+	require.Nil(t, err)
+	require.True(t, cfg.sampled())
+
+	t.Setenv("BLACKFIRE_CONPROF_SAMPLE_RATIO", "1.5")
+	_, err = newProfilerConfig()
+	require.ErrorContains(t, err, "sample ratio must be between 0 and 1 (1.5)")
+}
@@ -0,0 +1,90 @@
+package profiler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialsCacheTTL is how long the credentials returned by a provider are
+// used before asking it again.
+const credentialsCacheTTL = time.Minute
+
+// credentialsCache calls a credentials provider at most once per
+// credentialsCacheTTL, and keeps using the last credentials when the provider
+// fails.
+type credentialsCache struct {
+	provider func(ctx context.Context) (serverId, serverToken string, err error)
+
+	mu          sync.Mutex
+	serverId    string
+	serverToken string
+	fetched     time.Time
+	cached      bool // false until the provider returned credentials once
+}
+
+// get returns the cached credentials, asking the provider for new ones when
+// they are too old.
+func (c *credentialsCache) get(ctx context.Context) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cached && time.Since(c.fetched) < credentialsCacheTTL {
+		return c.serverId, c.serverToken, nil
+	}
+
+	id, token, err := c.provider(ctx)
+	if err != nil {
+		if !c.cached {
+			return "", "", fmt.Errorf("could not get the Blackfire credentials: %w", err)
+		}
+		log.Warn().Err(err).Msg("could not refresh the Blackfire credentials - using the previous ones")
+		return c.serverId, c.serverToken, nil
+	}
+
+	c.serverId, c.serverToken = id, token
+	c.fetched = time.Now()
+	c.cached = true
+	return id, token, nil
+}
+
+// invalidate makes the next call to get ask the provider, after the agent
+// rejected the credentials.
+func (c *credentialsCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fetched = time.Time{}
+}
+
+// fileCredentials returns a provider reading the credentials from the files
+// given through BLACKFIRE_SERVER_ID_FILE and BLACKFIRE_SERVER_TOKEN_FILE, as
+// mounted by secret managers. serverId and serverToken are used when the
+// corresponding file is not set.
+func fileCredentials(idFile, tokenFile, serverId, serverToken string) func(context.Context) (string, string, error) {
+	read := func(path, fallback string) (string, error) {
+		if path == "" {
+			return fallback, nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return func(context.Context) (string, string, error) {
+		id, err := read(idFile, serverId)
+		if err != nil {
+			return "", "", err
+		}
+		token, err := read(tokenFile, serverToken)
+		if err != nil {
+			return "", "", err
+		}
+		return id, token, nil
+	}
+}
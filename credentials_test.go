@@ -0,0 +1,82 @@
+package profiler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialsFiles(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	require.Nil(t, os.WriteFile(tokenFile, []byte("token1\n"), 0600))
+	t.Setenv("BLACKFIRE_SERVER_ID", "id")
+	t.Setenv("BLACKFIRE_SERVER_TOKEN_FILE", tokenFile)
+
+	var tokens []string
+	status := 200
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		id, token, _ := req.BasicAuth()
+		require.Equal(t, "id", id)
+		tokens = append(tokens, token)
+		return &http.Response{StatusCode: status, Body: http.NoBody}, nil
+	}
+	h := newTestClient(t, m, WithUploadRetries(0))
+	post := func() {
+		_, err := h.Post("http://localhost/profiling/v1/input", "text/plain", strings.NewReader("profile"))
+		require.Nil(t, err)
+	}
+
+	post()
+	require.Nil(t, os.WriteFile(tokenFile, []byte("token2\n"), 0600))
+	// The credentials are cached
+	status = 401
+	post()
+	// until the agent rejects them
+	status = 200
+	post()
+	require.Equal(t, []string{"token1", "token1", "token2"}, tokens)
+
+	// WithCredentials replaces the files
+	tokens = nil
+	h = newTestClient(t, m, WithCredentials("id", "static"))
+	post()
+	require.Equal(t, []string{"static"}, tokens)
+}
+
+func TestCredentialsProvider(t *testing.T) {
+	var providerErr error
+	calls := 0
+	provider := func(ctx context.Context) (string, string, error) {
+		calls++
+		return "id", "token", providerErr
+	}
+
+	c := &credentialsCache{provider: provider}
+	_, _, err := c.get(context.Background())
+	require.Nil(t, err)
+	_, _, err = c.get(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 1, calls)
+
+	// The previous credentials are kept when the provider fails
+	providerErr = errors.New("vault sealed")
+	c.invalidate()
+	id, token, err := c.get(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, "id", id)
+	require.Equal(t, "token", token)
+	require.Equal(t, 2, calls)
+
+	// Unless there are none
+	c = &credentialsCache{provider: provider}
+	_, _, err = c.get(context.Background())
+	require.ErrorContains(t, err, "vault sealed")
+}
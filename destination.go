@@ -0,0 +1,300 @@
+package profiler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// destinationQueueSize is the number of batches waiting for a destination
+// before the oldest one is dropped.
+const destinationQueueSize = 2
+
+// destination is an additional destination of the profiles, see
+// WithAgentDestination and WithExporterDestination.
+type destination struct {
+	agentSocket string   // empty for an exporter
+	exporter    Exporter // nil for an agent
+	opts        []Option // setting how the destination is reached
+}
+
+func (d *destination) String() string {
+	if d.exporter != nil {
+		return fmt.Sprintf("exporter %T", d.exporter)
+	}
+	return d.agentSocket
+}
+
+// destinationConfig returns the configuration of the uploads to d: the
+// settings of c telling how to reach the agent, changed by the options of d.
+func (c *config) destinationConfig(d *destination) *config {
+	dc := c.clone()
+	dc.spoolDir = ""
+	dc.apply(d.opts)
+	if d.exporter == nil {
+		dc.agentSocket = d.agentSocket
+	}
+	dc.discovery = false
+	dc.remoteInterval = 0
+	dc.breakerFailures = 0
+	dc.exporter = nil
+	dc.destinations = nil
+	return dc
+}
+
+// validateDestinations returns the errors of the configurations of the
+// additional destinations.
+func (c *config) validateDestinations() []error {
+	var errs []error
+	for _, d := range c.destinations {
+		if d.exporter == nil && d.agentSocket == "" {
+			errs = append(errs, errors.New("destination has no agent socket nor exporter"))
+			continue
+		}
+		dc := c.destinationConfig(d)
+		if d.exporter == nil {
+			if protocol, address, err := parseNetworkAddressString(dc.agentSocket); err != nil {
+				errs = append(errs, fmt.Errorf("destination %s: %w", d, err))
+			} else if _, err := agentAddress(protocol, address); err != nil {
+				errs = append(errs, fmt.Errorf("destination %s: %w", d, err))
+			}
+		}
+		var cerr *ConfigError
+		if err := dc.validate(); errors.As(err, &cerr) {
+			for _, err := range cerr.Errors {
+				errs = append(errs, fmt.Errorf("destination %s: %w", d, err))
+			}
+		}
+	}
+	return errs
+}
+
+// fanout sends the profiles to the main destination, and hands them to the
+// workers of the additional ones. Like flushTransport, it is both the
+// transport and the exporter of the backend.
+type fanout struct {
+	Transport http.RoundTripper
+	Exporter  Exporter
+
+	workers []*destinationWorker
+
+	// The DataDog profiler uploads a batch again when the upload fails: the
+	// last batch handed to the workers is remembered so that it is handed
+	// once.
+	mu        sync.Mutex
+	lastStart time.Time
+	lastSeq   int
+}
+
+// newFanout returns the fanout to the destinations of cfg, with their workers
+// started.
+func newFanout(cfg *config, t http.RoundTripper, e Exporter) (*fanout, error) {
+	f := &fanout{Transport: t, Exporter: e}
+	for _, d := range cfg.destinations {
+		dc := cfg.destinationConfig(d)
+		w := &destinationWorker{
+			name:     d.String(),
+			exporter: d.exporter,
+			timeout:  dc.uploadTimeout,
+			retries:  dc.uploadRetries,
+		}
+		if d.exporter == nil {
+			protocol, address, err := parseNetworkAddressString(dc.agentSocket)
+			if err != nil {
+				f.close(context.Background())
+				return nil, fmt.Errorf("invalid agent socket. (%s)", dc.agentSocket)
+			}
+			agentAddr, err := agentAddress(protocol, address)
+			if err != nil {
+				f.close(context.Background())
+				return nil, fmt.Errorf("%w [%v]", err, dc.agentSocket)
+			}
+			t, err := newBFTransport(dc, protocol, address)
+			if err != nil {
+				f.close(context.Background())
+				return nil, err
+			}
+			w.exporter = newAgentExporter(&http.Client{Transport: t}, "http://"+agentAddr+agentUploadPath)
+			// The transport retries on its own.
+			w.retries = 0
+		}
+		w.start()
+		f.workers = append(f.workers, w)
+	}
+	return f, nil
+}
+
+func (f *fanout) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err == nil {
+		r := req.Clone(req.Context())
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var b Batch
+		if b, err = decodeBatch(r); err == nil {
+			f.enqueue(b)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("could not read profile for the additional destinations")
+	}
+	return f.Transport.RoundTrip(req)
+}
+
+func (f *fanout) Export(ctx context.Context, b Batch) error {
+	f.enqueue(b)
+	return f.Exporter.Export(ctx, b)
+}
+
+// enqueue hands b to the workers, unless it is the last batch handed to
+// them.
+func (f *fanout) enqueue(b Batch) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.lastStart.IsZero() && f.lastStart.Equal(b.Start) && f.lastSeq == b.Seq {
+		return
+	}
+	f.lastStart, f.lastSeq = b.Start, b.Seq
+	for _, w := range f.workers {
+		c := b
+		c.Labels = maps.Clone(b.Labels)
+		w.enqueue(c)
+	}
+}
+
+// close waits for the workers to export the batches handed to them, or
+// aborts the exports once ctx is done. It returns the errors of their last
+// exports.
+func (f *fanout) close(ctx context.Context) error {
+	for _, w := range f.workers {
+		close(w.queue)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		for _, w := range f.workers {
+			w.cancel(context.Cause(ctx))
+		}
+	})
+	defer stop()
+
+	var errs []error
+	for _, w := range f.workers {
+		<-w.done
+		if w.err != nil {
+			errs = append(errs, fmt.Errorf("upload to %s failed: %w", w.name, w.err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// destinationWorker exports the batches to an additional destination in its
+// own goroutine, so that a slow or failing destination doesn't hold the
+// others.
+type destinationWorker struct {
+	name     string
+	exporter Exporter
+	timeout  time.Duration // of each export, retries included
+	retries  int           // of the failed exports
+
+	mu     sync.Mutex // serializes enqueue
+	queue  chan Batch
+	ctx    context.Context // cancelled by close once its context is done
+	cancel context.CancelCauseFunc
+	done   chan struct{} // closed once the queue is drained
+	err    error         // of the last export, read once done is closed
+}
+
+func (w *destinationWorker) start() {
+	w.queue = make(chan Batch, destinationQueueSize)
+	w.ctx, w.cancel = context.WithCancelCause(context.Background())
+	w.done = make(chan struct{})
+	go w.run()
+}
+
+func (w *destinationWorker) run() {
+	defer close(w.done)
+	for b := range w.queue {
+		if w.ctx.Err() != nil {
+			w.err = context.Cause(w.ctx)
+			continue
+		}
+		w.err = w.export(b)
+		if w.err != nil {
+			log.Error().Err(w.err).Str("destination", w.name).Msg("failed to upload profile")
+		}
+	}
+}
+
+// enqueue queues b, dropping the oldest queued batch if the destination is
+// behind.
+func (w *destinationWorker) enqueue(b Batch) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for {
+		select {
+		case w.queue <- b:
+			return
+		default:
+		}
+		select {
+		case dropped := <-w.queue:
+			log.Error().Str("destination", w.name).Time("start", dropped.Start).Msg("destination is too slow - profile dropped")
+		default:
+		}
+	}
+}
+
+// export exports b, retrying on failure with an exponential backoff, as long
+// as the timeout allows it.
+func (w *destinationWorker) export(b Batch) error {
+	ctx, cancel := context.WithTimeout(w.ctx, w.timeout)
+	defer cancel()
+
+	deadline := time.Now().Add(w.timeout)
+	for attempt := 0; ; attempt++ {
+		err := w.exporter.Export(ctx, b)
+		if err == nil || attempt == w.retries || ctx.Err() != nil {
+			return err
+		}
+
+		wait := retryBackoff(attempt)
+		if time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		log.Debug().Str("destination", w.name).Int("attempt", attempt+1).Dur("wait", wait).Err(err).Msg("upload failed - retrying")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// WithAgentDestination also uploads the profiles to the agent listening on
+// agentSocket, for instance while migrating to another agent. The options set
+// how that agent is reached, on top of the settings of the profiler: upload
+// timeout and retries, credentials, TLS, proxy, spool and connection
+// settings. The other options are ignored.
+//
+// Each additional destination is uploaded to in its own goroutine: a slow or
+// failing destination doesn't delay nor drop the uploads to the others.
+func WithAgentDestination(agentSocket string, opts ...Option) Option {
+	return func(cfg *config) {
+		cfg.destinations = append(cfg.destinations, &destination{agentSocket: agentSocket, opts: opts})
+	}
+}
+
+// WithExporterDestination also sends the profiles to e. Only the upload
+// timeout and retries options apply to it, failed exports being retried like
+// the uploads to the agent. See WithAgentDestination.
+func WithExporterDestination(e Exporter, opts ...Option) Option {
+	return func(cfg *config) {
+		cfg.destinations = append(cfg.destinations, &destination{exporter: e, opts: opts})
+	}
+}
@@ -0,0 +1,177 @@
+package profiler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pprof_profile "github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDestinations(t *testing.T) {
+	backends := []Backend{NativeBackend}
+	if hasDataDogBackend {
+		backends = append(backends, DataDogBackend)
+	}
+	for _, backend := range backends {
+		t.Run(backend.String(), func(t *testing.T) {
+			var (
+				mainUploads   = make(chan struct{}, 100)
+				backupUploads atomic.Int32
+				batches       = make(chan Batch, 100)
+				exports       atomic.Int32
+			)
+			m := &mockTransport{}
+			m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+				if req.URL.Host == "backup:8307" {
+					// A broken agent, never answering
+					backupUploads.Add(1)
+					<-req.Context().Done()
+					return nil, req.Context().Err()
+				}
+				mainUploads <- struct{}{}
+				return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+			}
+
+			p, err := New(period(200*time.Millisecond),
+				withTransport(m),
+				WithBackend(backend),
+				WithAgentSocket("tcp://main:8307"),
+				WithAgentDestination("tcp://backup:8307", WithUploadTimeout(300*time.Millisecond), WithUploadRetries(0)),
+				WithExporterDestination(ExporterFunc(func(ctx context.Context, b Batch) error {
+					// Fails every other time, and is retried
+					if exports.Add(1)%2 == 1 {
+						return errors.New("bucket unavailable")
+					}
+					batches <- b
+					return nil
+				}), WithUploadRetries(1)))
+			require.Nil(t, err)
+			require.Nil(t, p.Start(context.Background()))
+			defer p.Stop(context.Background())
+
+			// The broken agent holds neither the main agent nor the exporter
+			for range 3 {
+				select {
+				case <-mainUploads:
+				case <-time.After(5 * time.Second):
+					t.Fatal("test timeouted")
+				}
+			}
+			for range 2 {
+				select {
+				case b := <-batches:
+					require.NotEmpty(t, b.Profiles)
+				case <-time.After(5 * time.Second):
+					t.Fatal("test timeouted")
+				}
+			}
+			require.NotZero(t, backupUploads.Load())
+
+			require.ErrorContains(t, p.Update(WithAgentDestination("tcp://other:8307")), "destinations can't be updated")
+
+			// The final upload to the broken agent fails
+			err = p.Stop(context.Background())
+			require.ErrorIs(t, err, ErrProfilesDropped)
+			require.ErrorContains(t, err, "upload to tcp://backup:8307 failed")
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+		})
+	}
+}
+
+func TestConfigDestinations(t *testing.T) {
+	_, err := newProfilerConfig(
+		WithAgentDestination("backup"),
+		WithAgentDestination("tcp://backup:8307", WithUploadTimeout(-time.Second)),
+		WithExporterDestination(nil))
+	require.ErrorContains(t, err, "destination backup: could not parse agent socket value: [backup]")
+	require.ErrorContains(t, err, "destination tcp://backup:8307: upload timeout must be positive (-1s)")
+	require.ErrorContains(t, err, "destination has no agent socket nor exporter")
+
+	// The destinations inherit the settings of the profiler
+	cfg, err := newProfilerConfig(
+		WithUploadTimeout(3*time.Second),
+		WithCredentials("id", "token"),
+		WithSpoolDir(t.TempDir(), 1<<20),
+		WithAgentDestination("tcp://backup:8307", WithUploadRetries(5)))
+	require.Nil(t, err)
+	dc := cfg.destinationConfig(cfg.destinations[0])
+	require.Equal(t, "tcp://backup:8307", dc.agentSocket)
+	require.Equal(t, 3*time.Second, dc.uploadTimeout)
+	require.Equal(t, 5, dc.uploadRetries)
+	require.Equal(t, "id", dc.serverId)
+	require.Equal(t, "", dc.spoolDir)
+	require.Nil(t, dc.destinations)
+}
+
+func TestDestinationWorker(t *testing.T) {
+	release := make(chan struct{})
+	var exported []int
+	w := &destinationWorker{
+		name: "test",
+		exporter: ExporterFunc(func(ctx context.Context, b Batch) error {
+			<-release
+			exported = append(exported, b.Seq)
+			return nil
+		}),
+		timeout: time.Minute,
+	}
+	w.start()
+
+	// The worker is behind: the oldest queued batches are dropped
+	for seq := range 5 {
+		w.enqueue(Batch{Seq: seq})
+	}
+	close(release)
+	f := &fanout{workers: []*destinationWorker{w}}
+	require.Nil(t, f.close(context.Background()))
+	require.Equal(t, []int{3, 4}, exported[len(exported)-2:])
+	require.Less(t, len(exported), 5)
+}
+
+func TestFanoutRetriedUpload(t *testing.T) {
+	batches := make(chan Batch, 10)
+	w := &destinationWorker{
+		name: "test",
+		exporter: ExporterFunc(func(ctx context.Context, b Batch) error {
+			batches <- b
+			return nil
+		}),
+		timeout: time.Minute,
+	}
+	w.start()
+	f := &fanout{
+		Transport: &mockTransport{DoRoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil
+		}},
+		workers: []*destinationWorker{w},
+	}
+
+	var data bytes.Buffer
+	prof := &pprof_profile.Profile{SampleType: []*pprof_profile.ValueType{{Type: "samples", Unit: "count"}}}
+	require.Nil(t, prof.Write(&data))
+	b := Batch{
+		Start:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		End:      time.Date(2024, 1, 2, 3, 4, 50, 0, time.UTC),
+		Seq:      1,
+		Profiles: []ProfileData{{Name: "cpu.pprof", Data: data.Bytes()}},
+	}
+
+	// The DataDog profiler uploads the batch again when the agent fails: the
+	// destinations get it once
+	e := newAgentExporter(&http.Client{Transport: f}, "http://localhost"+agentUploadPath)
+	require.EqualError(t, e.Export(context.Background(), b), "got 503 response")
+	require.EqualError(t, e.Export(context.Background(), b), "got 503 response")
+	b.Seq = 2
+	require.EqualError(t, e.Export(context.Background(), b), "got 503 response")
+
+	require.Nil(t, f.close(context.Background()))
+	require.Len(t, batches, 2)
+	require.Equal(t, 1, (<-batches).Seq)
+	require.Equal(t, 2, (<-batches).Seq)
+}
@@ -0,0 +1,88 @@
+package profiler
+
+import (
+	"context"
+	"os"
+	"slices"
+)
+
+// wellKnownAgentSockets are the addresses where the agent is usually found in
+// containers, after the configured ones: the socket shared through a volume,
+// and the agent running as a sidecar or as a "blackfire" compose service.
+var wellKnownAgentSockets = []string{
+	"unix:///var/run/blackfire/agent.sock",
+	"unix:///run/blackfire/agent.sock",
+	"unix:///tmp/blackfire/agent.sock",
+	"tcp://127.0.0.1:8307",
+	"tcp://blackfire:8307",
+}
+
+// agentSocketCandidates returns the addresses tried by the agent discovery,
+// in order and without duplicates.
+func agentSocketCandidates(cfg *config) []string {
+	var candidates []string
+	add := func(socket string) {
+		if socket == "" {
+			return
+		}
+		if slices.Contains(candidates, socket) {
+			return
+		}
+		candidates = append(candidates, socket)
+	}
+
+	// Set with WithAgentSocket or BLACKFIRE_AGENT_SOCKET
+	if cfg.agentSocket != DefaultAgentSocket {
+		add(cfg.agentSocket)
+	}
+	add(os.Getenv("BLACKFIRE_AGENT_SOCKET"))
+	if ini, err := readBlackfireINI(); err == nil {
+		add(ini.get("agent_socket"))
+	}
+	add(DefaultAgentSocket)
+	for _, socket := range wellKnownAgentSockets {
+		add(socket)
+	}
+	return candidates
+}
+
+// discoverAgentSocket returns the first candidate address where an agent
+// answers a probe. When none answers, the configured address is kept.
+func discoverAgentSocket(ctx context.Context, cfg *config) string {
+	// Probes are not uploads, don't retry, spool nor count them.
+	probeCfg := *cfg
+	probeCfg.uploadRetries = 0
+	probeCfg.spoolDir = ""
+	probeCfg.breakerFailures = 0
+
+	for _, socket := range agentSocketCandidates(cfg) {
+		protocol, address, err := parseNetworkAddressString(socket)
+		if err != nil {
+			log.Debug().Err(err).Msg("skipping agent socket candidate")
+			continue
+		}
+		agentAddr, err := agentAddress(protocol, address)
+		if err != nil {
+			log.Debug().Err(err).Str("agent_socket", socket).Msg("skipping agent socket candidate")
+			continue
+		}
+		t, err := newBFTransport(&probeCfg, protocol, address)
+		if err != nil {
+			log.Debug().Err(err).Str("agent_socket", socket).Msg("skipping agent socket candidate")
+			continue
+		}
+
+		err = probeAgent(ctx, t, "http://"+agentAddr+agentUploadPath, cfg.connectTimeout)
+		if tr, ok := t.Transport.(interface{ CloseIdleConnections() }); ok {
+			tr.CloseIdleConnections()
+		}
+		if err == nil {
+			log.Info().Str("agent_socket", socket).Msg("Blackfire Agent discovered")
+			return socket
+		}
+		log.Debug().Err(err).Str("agent_socket", socket).Msg("no Blackfire Agent found")
+	}
+
+	log.Warn().Str("agent_socket", cfg.agentSocket).Msg("no Blackfire Agent discovered - using the configured agent socket")
+	return cfg.agentSocket
+}
@@ -0,0 +1,106 @@
+package profiler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseINI(t *testing.T) {
+	ini, err := parseINI(strings.NewReader(`
+; comment
+top = level
+[Blackfire]
+server-id = "abc"
+server-token='def'
+# comment
+malformed
+agent_socket=tcp://127.0.0.1:8307
+[other]
+server-id = xyz
+`))
+	require.Nil(t, err)
+	require.Equal(t, "level", ini.get("top"))
+	require.Equal(t, "abc", ini.get("server-id"))
+	require.Equal(t, "def", ini.get("server-token"))
+	require.Equal(t, "tcp://127.0.0.1:8307", ini.get("agent_socket"))
+	require.Equal(t, "xyz", ini["other"]["server-id"])
+	require.Equal(t, "", iniFile(nil).get("server-id"))
+}
+
+func TestAgentDiscovery(t *testing.T) {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer agent.Close()
+	iniSocket := "tcp://" + strings.TrimPrefix(agent.URL, "http://")
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	require.Nil(t, os.WriteFile(filepath.Join(home, ".blackfire.ini"), []byte("[blackfire]\nagent_socket="+iniSocket+"\n"), 0600))
+	envSocket := "unix://" + filepath.Join(home, "agent.sock")
+	t.Setenv("BLACKFIRE_AGENT_SOCKET", envSocket)
+
+	cfg, err := newProfilerConfig(WithAgentDiscovery(true), WithConnectTimeout(200*time.Millisecond))
+	require.Nil(t, err)
+
+	candidates := agentSocketCandidates(cfg)
+	require.Equal(t, []string{envSocket, iniSocket, DefaultAgentSocket}, candidates[:3])
+	require.Equal(t, "tcp://blackfire:8307", candidates[len(candidates)-1])
+
+	require.Equal(t, iniSocket, discoverAgentSocket(context.Background(), cfg))
+
+	// The configured socket is kept when no agent answers
+	agent.Close()
+	require.Equal(t, envSocket, discoverAgentSocket(context.Background(), cfg))
+}
+
+func TestAgentDiscoveryWithoutLock(t *testing.T) {
+	probed := make(chan struct{}, 1)
+	release := make(chan struct{})
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == agentUploadPath {
+			select {
+			case probed <- struct{}{}:
+			default:
+			}
+			<-release
+		}
+		w.WriteHeader(200)
+	}))
+	defer agent.Close()
+	socket := "tcp://" + strings.TrimPrefix(agent.URL, "http://")
+	t.Setenv("HOME", t.TempDir())
+
+	p, err := New(WithAgentSocket(socket), WithAgentDiscovery(true), WithConnectTimeout(5*time.Second), WithProfileTypes(CPUProfile))
+	require.Nil(t, err)
+	started := make(chan error, 1)
+	go func() {
+		started <- p.Start(context.Background())
+	}()
+	defer p.Stop(context.Background())
+
+	select {
+	case <-probed:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("test timeouted")
+	}
+	// The other callers aren't held up by the probes
+	locked := mu.TryLock()
+	if locked {
+		mu.Unlock()
+	}
+	close(release)
+	require.Nil(t, <-started)
+	require.True(t, locked)
+	require.Equal(t, socket, p.Config().AgentSocket)
+	require.True(t, p.Status().Running)
+}
@@ -0,0 +1,265 @@
+package profiler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Exporter sends the profiles collected over a period to their destination.
+// By default, they are uploaded to the Blackfire Agent. See WithExporter.
+type Exporter interface {
+	// Export sends the batch. It is called once per period, never
+	// concurrently, with a context bounded by the upload timeout and
+	// cancelled when Stop gives up on the final profiles.
+	Export(ctx context.Context, b Batch) error
+}
+
+// ExporterFunc adapts a function to the Exporter interface.
+type ExporterFunc func(ctx context.Context, b Batch) error
+
+func (f ExporterFunc) Export(ctx context.Context, b Batch) error {
+	return f(ctx, b)
+}
+
+// Batch is the profiles collected over a period.
+type Batch struct {
+	Start time.Time
+	End   time.Time
+	// Seq numbers the batches since Start, from 0.
+	Seq      int
+	Labels   map[string]string
+	Profiles []ProfileData
+}
+
+// ProfileData is a profile of a Batch.
+type ProfileData struct {
+	// Name identifies the profile: "cpu.pprof", "delta-heap.pprof",
+	// "delta-block.pprof", "delta-mutex.pprof" or "goroutines.pprof". Delta
+	// profiles hold the allocations and contentions of the period only. The
+	// DataDog backend adds its own parts, such as "metrics.json".
+	Name string
+	// Data is the profile in the gzip compressed protobuf format written by
+	// runtime/pprof and read by go tool pprof, or the part as is when it is
+	// not a profile.
+	Data []byte
+}
+
+// zstdMagic starts zstd compressed data.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// uploadEvent is the event.json part of the uploads to the agent.
+type uploadEvent struct {
+	Start       string   `json:"start"`
+	End         string   `json:"end"`
+	Attachments []string `json:"attachments"`
+	Tags        string   `json:"tags_profiler"`
+	Family      string   `json:"family"`
+	Version     string   `json:"version"`
+}
+
+// agentExporter uploads the batches to the agent in the format of the
+// DataDog profiler.
+type agentExporter struct {
+	client  *http.Client
+	url     string
+	service string
+	encoder *zstd.Encoder
+}
+
+func newAgentExporter(client *http.Client, url string) *agentExporter {
+	// Can only fail on invalid options.
+	encoder, _ := zstd.NewWriter(nil)
+	return &agentExporter{
+		client:  client,
+		url:     url,
+		service: filepath.Base(os.Args[0]),
+		encoder: encoder,
+	}
+}
+
+func (e *agentExporter) Export(ctx context.Context, b Batch) error {
+	body, contentType, err := e.encode(b)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	response, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("got %d response", response.StatusCode)
+	}
+	return nil
+}
+
+// encode returns the multipart body of the upload of b.
+func (e *agentExporter) encode(b Batch) ([]byte, string, error) {
+	tags := make([]string, 0, len(b.Labels)+2)
+	for _, name := range slices.Sorted(maps.Keys(b.Labels)) {
+		tags = append(tags, name+":"+b.Labels[name])
+	}
+	if _, ok := b.Labels["service"]; !ok {
+		tags = append(tags, "service:"+e.service)
+	}
+	tags = append(tags, fmt.Sprintf("profile_seq:%d", b.Seq))
+
+	event := uploadEvent{
+		Start:   b.Start.Format(time.RFC3339Nano),
+		End:     b.End.Format(time.RFC3339Nano),
+		Tags:    strings.Join(tags, ","),
+		Family:  "go",
+		Version: "4",
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, p := range b.Profiles {
+		r, err := gzip.NewReader(bytes.NewReader(p.Data))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid %s profile: %w", p.Name, err)
+		}
+		raw, err := io.ReadAll(r)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid %s profile: %w", p.Name, err)
+		}
+		event.Attachments = append(event.Attachments, p.Name)
+		w, err := mw.CreateFormFile(p.Name, p.Name)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := w.Write(e.encoder.EncodeAll(raw, nil)); err != nil {
+			return nil, "", err
+		}
+	}
+	w, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": []string{`form-data; name="event"; filename="event.json"`},
+		"Content-Type":        []string{"application/json"},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := json.NewEncoder(w).Encode(event); err != nil {
+		return nil, "", err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), mw.FormDataContentType(), nil
+}
+
+// exporterTransport hands the uploads of the DataDog profiler to an Exporter.
+type exporterTransport struct {
+	Exporter Exporter
+}
+
+func (t *exporterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b, err := decodeBatch(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Exporter.Export(req.Context(), b); err != nil {
+		return nil, err
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+// decodeBatch returns the batch uploaded by req, as encoded by the DataDog
+// profiler.
+func decodeBatch(req *http.Request) (Batch, error) {
+	b := Batch{Labels: map[string]string{}}
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return b, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return b, err
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return b, err
+		}
+
+		if part.FormName() == "event" {
+			if err := decodeEvent(data, &b); err != nil {
+				return b, err
+			}
+			continue
+		}
+
+		if bytes.HasPrefix(data, zstdMagic) {
+			decoder, err := zstd.NewReader(nil)
+			if err != nil {
+				return b, err
+			}
+			raw, err := decoder.DecodeAll(data, nil)
+			decoder.Close()
+			if err != nil {
+				return b, fmt.Errorf("invalid %s profile: %w", part.FileName(), err)
+			}
+			var buf bytes.Buffer
+			w, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+			w.Write(raw)
+			w.Close()
+			data = buf.Bytes()
+		}
+		b.Profiles = append(b.Profiles, ProfileData{Name: part.FileName(), Data: data})
+	}
+}
+
+// decodeEvent sets the start, end, sequence number and labels of b from the
+// event part of an upload.
+func decodeEvent(data []byte, b *Batch) error {
+	var event uploadEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return fmt.Errorf("invalid event: %w", err)
+	}
+	b.Start, _ = time.Parse(time.RFC3339Nano, event.Start)
+	b.End, _ = time.Parse(time.RFC3339Nano, event.End)
+	for _, tag := range strings.Split(event.Tags, ",") {
+		name, value, ok := strings.Cut(tag, ":")
+		if !ok {
+			continue
+		}
+		if name == "profile_seq" {
+			b.Seq, _ = strconv.Atoi(value)
+			continue
+		}
+		b.Labels[name] = value
+	}
+	return nil
+}
+
+// WithExporter sends the profiles to e instead of the Blackfire Agent.
+func WithExporter(e Exporter) Option {
+	return func(cfg *config) {
+		cfg.exporter = e
+	}
+}
@@ -0,0 +1,200 @@
+package profiler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dirExporterTimeFormat = "20060102T150405.000000000Z"
+	dirExporterExt        = ".pprof"
+	dirExporterLabelsExt  = ".json"
+)
+
+// DirExporter is an Exporter writing the profiles as pprof files into a
+// directory, for go tool pprof. Each profile is written to
+// <application_name>_<type>_<start>.pprof, type being the ProfileType, next to
+// a .json file of the same name holding the labels and the period.
+type DirExporter struct {
+	dir      string
+	maxFiles int
+	maxBytes int64
+
+	mu sync.Mutex
+}
+
+// dirExporterLabels is the content of the .json file written next to each
+// profile.
+type dirExporterLabels struct {
+	Type   string            `json:"type"`
+	Start  time.Time         `json:"start"`
+	End    time.Time         `json:"end"`
+	Seq    int               `json:"seq"`
+	Labels map[string]string `json:"labels"`
+}
+
+// NewDirExporter returns an Exporter writing the profiles into dir, which is
+// created if needed. Once more than maxFiles profiles, or more than maxBytes
+// with the .json files, are in dir, the oldest ones are removed. Zero means no
+// limit.
+func NewDirExporter(dir string, maxFiles int, maxBytes int64) (*DirExporter, error) {
+	if maxFiles < 0 || maxBytes < 0 {
+		return nil, fmt.Errorf("invalid retention limits: %d files, %d bytes", maxFiles, maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create profile directory: %w", err)
+	}
+	return &DirExporter{
+		dir:      dir,
+		maxFiles: maxFiles,
+		maxBytes: maxBytes,
+	}, nil
+}
+
+func (e *DirExporter) Export(ctx context.Context, b Batch) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	app := sanitizeFileName(b.Labels["application_name"])
+	if app == "" {
+		app = sanitizeFileName(filepath.Base(os.Args[0]))
+	}
+	for _, p := range b.Profiles {
+		t, ok := profileTypeOf(p.Name)
+		if !ok {
+			// Such as the metrics.json part of the DataDog backend.
+			log.Debug().Str("part", p.Name).Msg("not a profile, not written")
+			continue
+		}
+		base := filepath.Join(e.dir, fmt.Sprintf("%s_%s_%s", app, t, b.Start.UTC().Format(dirExporterTimeFormat)))
+
+		labels, err := json.MarshalIndent(dirExporterLabels{
+			Type:   t.String(),
+			Start:  b.Start,
+			End:    b.End,
+			Seq:    b.Seq,
+			Labels: b.Labels,
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(base+dirExporterLabelsExt, labels); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(base+dirExporterExt, p.Data); err != nil {
+			os.Remove(base + dirExporterLabelsExt)
+			return err
+		}
+	}
+
+	e.prune()
+	return nil
+}
+
+// prune removes the oldest profiles, with their .json file, until the
+// directory fits in the limits. Must be called with mu held.
+func (e *DirExporter) prune() {
+	if e.maxFiles == 0 && e.maxBytes == 0 {
+		return
+	}
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		log.Error().Err(err).Str("dir", e.dir).Msg("could not list exported profiles")
+		return
+	}
+
+	type exported struct {
+		base  string
+		start string
+		size  int64
+	}
+	var (
+		kept  []exported
+		total int64
+	)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), dirExporterExt)
+		if entry.IsDir() || !ok {
+			continue
+		}
+		// Only the files written by a DirExporter are pruned.
+		start := name[strings.LastIndexByte(name, '_')+1:]
+		if _, err := time.Parse(dirExporterTimeFormat, start); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		base := filepath.Join(e.dir, name)
+		size := info.Size()
+		if info, err := os.Stat(base + dirExporterLabelsExt); err == nil {
+			size += info.Size()
+		}
+		kept = append(kept, exported{base, start, size})
+		total += size
+	}
+	// The timestamps sort as strings.
+	slices.SortStableFunc(kept, func(a, b exported) int { return strings.Compare(a.start, b.start) })
+
+	for len(kept) > 0 && ((e.maxFiles > 0 && len(kept) > e.maxFiles) || (e.maxBytes > 0 && total > e.maxBytes)) {
+		log.Debug().Str("file", kept[0].base+dirExporterExt).Msg("discarding oldest exported profile")
+		os.Remove(kept[0].base + dirExporterExt)
+		os.Remove(kept[0].base + dirExporterLabelsExt)
+		total -= kept[0].size
+		kept = kept[1:]
+	}
+}
+
+// profileTypeOf returns the type of the profile named name in a Batch. The
+// heap profile of the DataDog backend also holds the allocations.
+func profileTypeOf(name string) (ProfileType, bool) {
+	switch name {
+	case "cpu.pprof":
+		return CPUProfile, true
+	case "delta-heap.pprof":
+		return HeapProfile, true
+	case "delta-alloc.pprof":
+		return AllocationProfile, true
+	case "delta-block.pprof":
+		return BlockProfile, true
+	case "delta-mutex.pprof":
+		return MutexProfile, true
+	case "goroutines.pprof":
+		return GoroutineProfile, true
+	default:
+		return 0, false
+	}
+}
+
+// sanitizeFileName replaces the characters of s that are not safe in a file
+// name, and the underscores separating the parts of the name, with dashes.
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+// writeFileAtomic writes data to path through a temporary file, so that
+// readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package profiler
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pprof_profile "github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirExporter(t *testing.T) {
+	dir := t.TempDir()
+	e, err := NewDirExporter(dir, 4, 0)
+	require.Nil(t, err)
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	batch := func(seq int) Batch {
+		return Batch{
+			Start:  start.Add(time.Duration(seq) * time.Minute),
+			End:    start.Add(time.Duration(seq+1) * time.Minute),
+			Seq:    seq,
+			Labels: map[string]string{"application_name": "my app", "k1": "v1"},
+			Profiles: []ProfileData{
+				{Name: "cpu.pprof", Data: []byte("cpu")},
+				{Name: "delta-heap.pprof", Data: []byte("heap")},
+				{Name: "metrics.json", Data: []byte("{}")},
+			},
+		}
+	}
+
+	require.Nil(t, e.Export(context.Background(), batch(0)))
+	require.Equal(t, []string{
+		"my-app_cpu_20240102T030405.000000000Z.json",
+		"my-app_cpu_20240102T030405.000000000Z.pprof",
+		"my-app_heap_20240102T030405.000000000Z.json",
+		"my-app_heap_20240102T030405.000000000Z.pprof",
+	}, spooledFiles(t, dir))
+
+	data, err := os.ReadFile(filepath.Join(dir, "my-app_heap_20240102T030405.000000000Z.pprof"))
+	require.Nil(t, err)
+	require.Equal(t, "heap", string(data))
+
+	data, err = os.ReadFile(filepath.Join(dir, "my-app_heap_20240102T030405.000000000Z.json"))
+	require.Nil(t, err)
+	var labels dirExporterLabels
+	require.Nil(t, json.Unmarshal(data, &labels))
+	require.Equal(t, "heap", labels.Type)
+	require.True(t, start.Equal(labels.Start))
+	require.Equal(t, "v1", labels.Labels["k1"])
+
+	// Only the last 4 profiles are kept
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "notes.pprof"), []byte("not exported"), 0600))
+	for seq := 1; seq < 4; seq++ {
+		require.Nil(t, e.Export(context.Background(), batch(seq)))
+	}
+	require.Equal(t, []string{
+		"my-app_cpu_20240102T030605.000000000Z.json",
+		"my-app_cpu_20240102T030605.000000000Z.pprof",
+		"my-app_cpu_20240102T030705.000000000Z.json",
+		"my-app_cpu_20240102T030705.000000000Z.pprof",
+		"my-app_heap_20240102T030605.000000000Z.json",
+		"my-app_heap_20240102T030605.000000000Z.pprof",
+		"my-app_heap_20240102T030705.000000000Z.json",
+		"my-app_heap_20240102T030705.000000000Z.pprof",
+		"notes.pprof",
+	}, spooledFiles(t, dir))
+
+	// The size limit includes the .json files
+	size := int64(0)
+	for _, name := range []string{
+		"my-app_cpu_20240102T030705.000000000Z.json",
+		"my-app_cpu_20240102T030705.000000000Z.pprof",
+		"my-app_heap_20240102T030705.000000000Z.json",
+		"my-app_heap_20240102T030705.000000000Z.pprof",
+	} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		require.Nil(t, err)
+		size += info.Size()
+	}
+	e, err = NewDirExporter(dir, 0, size)
+	require.Nil(t, err)
+	e.prune()
+	require.Equal(t, []string{
+		"my-app_cpu_20240102T030705.000000000Z.json",
+		"my-app_cpu_20240102T030705.000000000Z.pprof",
+		"my-app_heap_20240102T030705.000000000Z.json",
+		"my-app_heap_20240102T030705.000000000Z.pprof",
+		"notes.pprof",
+	}, spooledFiles(t, dir))
+
+	// The allocations of the native backend are apart from the heap
+	require.Nil(t, e.Export(context.Background(), Batch{
+		Start:    start.Add(10 * time.Minute),
+		Labels:   map[string]string{"application_name": "my app"},
+		Profiles: []ProfileData{{Name: "delta-alloc.pprof", Data: []byte("alloc")}},
+	}))
+	require.Contains(t, spooledFiles(t, dir), "my-app_alloc_20240102T031405.000000000Z.pprof")
+
+	_, err = NewDirExporter(dir, -1, 0)
+	require.ErrorContains(t, err, "invalid retention limits")
+}
+
+func TestDirExporterProfiler(t *testing.T) {
+	dir := t.TempDir()
+	e, err := NewDirExporter(dir, 0, 0)
+	require.Nil(t, err)
+
+	p, err := New(period(200*time.Millisecond),
+		WithBackend(NativeBackend),
+		WithExporter(e),
+		WithAppName("app"),
+		WithProfileTypes(CPUProfile, HeapProfile))
+	require.Nil(t, err)
+	require.Nil(t, p.Start(context.Background()))
+	require.Nil(t, p.Stop(context.Background()))
+
+	files, err := filepath.Glob(filepath.Join(dir, "app_cpu_*.pprof"))
+	require.Nil(t, err)
+	require.NotEmpty(t, files)
+	f, err := os.Open(files[0])
+	require.Nil(t, err)
+	defer f.Close()
+	prof, err := pprof_profile.Parse(f)
+	require.Nil(t, err)
+	require.Equal(t, "cpu", prof.SampleType[1].Type)
+
+	files, err = filepath.Glob(filepath.Join(dir, "app_heap_*.pprof"))
+	require.Nil(t, err)
+	require.NotEmpty(t, files)
+}
@@ -0,0 +1,135 @@
+package profiler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	pprof_profile "github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentExporter(t *testing.T) {
+	prof := &pprof_profile.Profile{
+		SampleType: []*pprof_profile.ValueType{{Type: "samples", Unit: "count"}},
+		PeriodType: &pprof_profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+	}
+	var data []byte
+	{
+		var buf = &bytesWriter{}
+		require.Nil(t, prof.Write(buf))
+		data = buf.b
+	}
+	b := Batch{
+		Start:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		End:      time.Date(2024, 1, 2, 3, 4, 50, 0, time.UTC),
+		Seq:      3,
+		Labels:   map[string]string{"application_name": "app", "service": "svc"},
+		Profiles: []ProfileData{{Name: "cpu.pprof", Data: data}},
+	}
+
+	var uploaded *http.Request
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		uploaded = req
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+	e := newAgentExporter(&http.Client{Transport: m}, "http://localhost"+agentUploadPath)
+	require.Nil(t, e.Export(context.Background(), b))
+	require.Equal(t, agentUploadPath, uploaded.URL.Path)
+
+	// The upload parses as the ones of the DataDog profiler
+	decoded, err := decodeBatch(uploaded)
+	require.Nil(t, err)
+	require.True(t, b.Start.Equal(decoded.Start))
+	require.True(t, b.End.Equal(decoded.End))
+	require.Equal(t, b.Seq, decoded.Seq)
+	require.Equal(t, b.Labels, decoded.Labels)
+	require.Len(t, decoded.Profiles, 1)
+	require.Equal(t, "cpu.pprof", decoded.Profiles[0].Name)
+	p, err := pprof_profile.ParseData(decoded.Profiles[0].Data)
+	require.Nil(t, err)
+	require.Equal(t, "samples", p.SampleType[0].Type)
+
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 500, Body: http.NoBody}, nil
+	}
+	require.EqualError(t, e.Export(context.Background(), b), "got 500 response")
+}
+
+type bytesWriter struct {
+	b []byte
+}
+
+func (w *bytesWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+func TestExporter(t *testing.T) {
+	backends := []Backend{NativeBackend}
+	if hasDataDogBackend {
+		backends = append(backends, DataDogBackend)
+	}
+	for _, backend := range backends {
+		t.Run(backend.String(), func(t *testing.T) {
+			var (
+				lock    sync.Mutex
+				fail    bool
+				batches = make(chan Batch, 10)
+			)
+			e := ExporterFunc(func(ctx context.Context, b Batch) error {
+				lock.Lock()
+				defer lock.Unlock()
+				if fail {
+					return errors.New("bucket unavailable")
+				}
+				batches <- b
+				return nil
+			})
+
+			p, err := New(period(200*time.Millisecond),
+				withTransport(&mockTransport{DoRoundTripFunc: func(req *http.Request) (*http.Response, error) {
+					t.Error("unexpected request to the agent")
+					return nil, errors.New("unexpected")
+				}}),
+				WithBackend(backend),
+				WithExporter(e),
+				WithLabels(map[string]string{"k1": "v1"}))
+			require.Nil(t, err)
+			require.Nil(t, p.Start(context.Background()))
+			defer p.Stop(context.Background())
+
+			var b Batch
+			select {
+			case b = <-batches:
+			case <-time.After(5 * time.Second):
+				t.Fatal("test timeouted")
+			}
+			require.Equal(t, "v1", b.Labels["k1"])
+			require.False(t, b.End.Before(b.Start))
+			i := slices.IndexFunc(b.Profiles, func(p ProfileData) bool { return p.Name == "cpu.pprof" })
+			require.NotEqual(t, -1, i)
+			prof, err := pprof_profile.ParseData(b.Profiles[i].Data)
+			require.Nil(t, err)
+			require.Equal(t, "cpu", prof.SampleType[1].Type)
+
+			// The exporter can't be updated
+			require.ErrorContains(t, p.Update(WithExporter(ExporterFunc(func(context.Context, Batch) error { return nil }))),
+				"exporter can't be updated")
+			require.Nil(t, p.Update(WithLabels(map[string]string{"k2": "v2"})))
+
+			// The exporter errors are reported by Stop
+			lock.Lock()
+			fail = true
+			lock.Unlock()
+			err = p.Stop(context.Background())
+			require.ErrorIs(t, err, ErrProfilesDropped)
+			require.ErrorContains(t, err, "bucket unavailable")
+		})
+	}
+}
@@ -0,0 +1,17 @@
+// Package expvar publishes the self-metrics of the Blackfire continuous
+// profiler with expvar as "blackfire_conprof" when it is imported. The
+// profiler doesn't import expvar itself, as it serves /debug/vars on
+// http.DefaultServeMux.
+package expvar
+
+import (
+	"expvar"
+
+	profiler "github.com/blackfireio/go-continuous-profiling"
+)
+
+func init() {
+	expvar.Publish("blackfire_conprof", expvar.Func(func() any {
+		return profiler.Metrics()
+	}))
+}
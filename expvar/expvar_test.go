@@ -0,0 +1,19 @@
+package expvar
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	profiler "github.com/blackfireio/go-continuous-profiling"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublish(t *testing.T) {
+	v := expvar.Get("blackfire_conprof")
+	require.NotNil(t, v)
+
+	var e profiler.ProfilerMetrics
+	require.Nil(t, json.Unmarshal([]byte(v.String()), &e))
+	require.Len(t, e.Failures, len(profiler.FailureReasons))
+}
@@ -2,43 +2,346 @@ package profiler
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUploadRetries is the number of times a failed upload is retried.
+	DefaultUploadRetries = 2
+
+	// DefaultConnectTimeout is how long connecting to the agent may take.
+	DefaultConnectTimeout = 5 * time.Second
+	// DefaultKeepAlive is the interval between TCP keep-alive probes.
+	DefaultKeepAlive = 30 * time.Second
+	// DefaultMaxIdleConns is the number of idle connections to the agent kept
+	// for the next uploads.
+	DefaultMaxIdleConns = 2
+	// DefaultIdleConnTimeout is how long an idle connection to the agent is
+	// kept. It is longer than the default period, so that the connection is
+	// reused by the next upload.
+	DefaultIdleConnTimeout = 90 * time.Second
+
+	retryMinBackoff = 500 * time.Millisecond
+	retryMaxBackoff = 5 * time.Second
 )
 
 func NewHTTPClient(protocol, address, serverId, serverToken string) *http.Client {
-	t := &http.Transport{
+	t := &bfTransport{
+		Transport: newTransport(protocol, address, &config{
+			connectTimeout:  DefaultConnectTimeout,
+			keepAlive:       DefaultKeepAlive,
+			maxIdleConns:    DefaultMaxIdleConns,
+			idleConnTimeout: DefaultIdleConnTimeout,
+		}),
+		serverId:    serverId,
+		serverToken: serverToken,
+	}
+	if protocol == "https" {
+		t.scheme = "https"
+	}
+	return &http.Client{Transport: t}
+}
+
+// newBFTransport returns the transport used to upload profiles to the agent,
+// set up from the configuration.
+func newBFTransport(cfg *config, protocol, address string) (*bfTransport, error) {
+	t := &bfTransport{
+		Transport:     cfg.transport,
+		serverId:      cfg.serverId,
+		serverToken:   cfg.serverToken,
+		retries:       cfg.uploadRetries,
+		uploadTimeout: cfg.uploadTimeout,
+		stats:         &uploadStats{},
+	}
+	if t.Transport == nil {
+		tr := newTransport(protocol, address, cfg)
+		if cfg.useTLS(protocol) {
+			// The agent certificate is verified for the host dialed.
+			host, err := agentAddress(protocol, address)
+			if err != nil {
+				return nil, err
+			}
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			tc, err := newTLSConfig(cfg, host)
+			if err != nil {
+				return nil, err
+			}
+			tr.TLSClientConfig = tc
+			t.scheme = "https"
+		}
+		if cfg.proxy != "" && protocol != "unix" {
+			u, err := parseProxyURL(cfg.proxy)
+			if err != nil {
+				return nil, err
+			}
+			tr.Proxy = http.ProxyURL(u)
+		}
+		t.Transport = tr
+	}
+
+	if cfg.credentialsProvider != nil {
+		t.credentials = &credentialsCache{provider: cfg.credentialsProvider}
+	}
+
+	if cfg.spoolDir != "" {
+		s, err := newSpool(cfg.spoolDir, cfg.spoolMaxBytes, cfg.spoolMaxAge, cfg.uploadTimeout)
+		if err != nil {
+			return nil, err
+		}
+		t.spool = s
+	}
+
+	if cfg.breakerFailures > 0 {
+		t.breaker = newBreaker(cfg.breakerFailures)
+	}
+
+	return t, nil
+}
+
+// newTransport returns the transport connecting to the agent, with the
+// connection settings of cfg.
+func newTransport(protocol, address string, cfg *config) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   cfg.connectTimeout,
+		KeepAlive: cfg.keepAlive,
+	}
+	tr := &http.Transport{
 		DialContext: func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
 			if protocol == "unix" {
-				return net.Dial("unix", address)
+				return dialer.DialContext(ctx, "unix", address)
 			}
 
-			return net.Dial(network, addr)
+			return dialer.DialContext(ctx, network, addr)
 		},
+		TLSHandshakeTimeout: cfg.connectTimeout,
+		MaxIdleConns:        cfg.maxIdleConns,
+		MaxIdleConnsPerHost: cfg.maxIdleConns,
+		IdleConnTimeout:     cfg.idleConnTimeout,
+		DisableKeepAlives:   cfg.maxIdleConns == 0,
 	}
-
-	return &http.Client{
-		Transport: &bfTransport{
-			Transport:   t,
-			serverId:    serverId,
-			serverToken: serverToken,
-		},
+	// Unix sockets are local, the proxy settings don't apply to them.
+	if protocol != "unix" {
+		tr.Proxy = http.ProxyFromEnvironment
 	}
+	return tr
 }
 
 type bfTransport struct {
 	Transport   http.RoundTripper
 	serverId    string
 	serverToken string
+	credentials *credentialsCache // replaces serverId and serverToken when set
+	scheme      string            // replaces the scheme of the requests when set
+	spool       *spool            // nil when spooling is disabled
+	breaker     *breaker          // nil when the circuit breaker is disabled
+	stats       *uploadStats
+
+	// retries is the number of times a failed upload is retried, within
+	// uploadTimeout.
+	retries       int
+	uploadTimeout time.Duration
 }
 
 func (t *bfTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if t.serverId != "" && t.serverToken != "" {
-		req.SetBasicAuth(t.serverId, t.serverToken)
+	start := time.Now()
+	response, err := t.upload(req)
+	t.record(req, response, err, time.Since(start))
+	return response, err
+}
+
+// record records the outcome of an upload that took latency, in the circuit
+// breaker, the status and the metrics.
+func (t *bfTransport) record(req *http.Request, response *http.Response, err error, latency time.Duration) {
+	r, ok := newUploadResult(req, response, err, latency)
+	if !ok {
+		return
+	}
+	if t.breaker != nil {
+		t.breaker.record(r)
 	}
+	t.stats.record(r)
+	metrics.record(r)
+}
 
-	response, err := t.Transport.RoundTrip(req)
+// uploadResult is the outcome of an upload, classified once for the circuit
+// breaker, the status and the metrics.
+type uploadResult struct {
+	bytes   int64 // sent, zero when unknown
+	latency time.Duration
+	err     error         // nil on success, set for the non-2xx responses too
+	reason  FailureReason // empty on success
+}
+
+// newUploadResult classifies an upload that took latency. It reports false
+// for the uploads cancelled while stopping, which say nothing about the
+// agent.
+func newUploadResult(req *http.Request, response *http.Response, err error, latency time.Duration) (uploadResult, bool) {
+	if errors.Is(err, context.Canceled) {
+		return uploadResult{}, false
+	}
+	r := uploadResult{bytes: max(req.ContentLength, 0), latency: latency}
+	if reason, failed := failureReason(response, err); failed {
+		r.reason = reason
+		r.err = err
+		if r.err == nil {
+			r.err = fmt.Errorf("got %d response", response.StatusCode)
+		}
+	}
+	return r, true
+}
+
+// agentAnswered reports whether the agent took the upload, or answered that
+// it couldn't.
+func (r uploadResult) agentAnswered() bool {
+	return r.reason == "" || r.reason == FailureStatus
+}
+
+// replay sends a spooled request once, recording its outcome like the
+// uploads.
+func (t *bfTransport) replay(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	response, err := t.send(req)
+	t.record(req, response, err, time.Since(start))
+	return response, err
+}
+
+// close stops replaying the spooled uploads.
+func (t *bfTransport) close() {
+	if t.spool != nil {
+		t.spool.close()
+	}
+}
+
+// upload sends the profiles, retrying and spooling them as configured.
+func (t *bfTransport) upload(req *http.Request) (*http.Response, error) {
+	if t.spool == nil && t.retries == 0 {
+		return t.send(req)
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := t.sendWithRetries(req)
+	if t.spool == nil {
+		return response, err
+	}
+
+	if temporaryFailure(response, err) {
+		if serr := t.spool.store(req, body); serr != nil {
+			log.Error().Str("endpoint", req.URL.String()).Err(serr).Msg("could not spool profile")
+		} else {
+			log.Debug().Str("endpoint", req.URL.String()).Msg("agent unavailable - profile spooled")
+		}
+	} else if err == nil && response.StatusCode >= 200 && response.StatusCode <= 299 {
+		// The agent is back, send what it missed.
+		t.spool.replay(t.replay)
+	}
+
+	return response, err
+}
+
+// sendWithRetries sends the request, retrying on temporary failures with an
+// exponential backoff, as long as the upload timeout allows it.
+func (t *bfTransport) sendWithRetries(req *http.Request) (*http.Response, error) {
+	deadline := time.Now().Add(t.uploadTimeout)
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 && req.GetBody != nil {
+			r = req.Clone(req.Context())
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		response, err := t.send(r)
+		if attempt == t.retries || req.Context().Err() != nil || !temporaryFailure(response, err) {
+			return response, err
+		}
+
+		wait := retryBackoff(attempt)
+		if d, ok := retryAfter(response); ok {
+			wait = d
+		}
+		if time.Now().Add(wait).After(deadline) {
+			log.Debug().Str("endpoint", req.URL.String()).Int("attempt", attempt+1).Msg("upload failed - no time left to retry")
+			return response, err
+		}
+
+		event := log.Debug().Str("endpoint", req.URL.String()).Int("attempt", attempt+1).Dur("wait", wait)
+		if err != nil {
+			event.Err(err).Msg("upload failed - retrying")
+		} else {
+			event.Int("status", response.StatusCode).Msg("upload failed - retrying")
+			if response.Body != nil {
+				response.Body.Close()
+			}
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryBackoff returns how long to wait before the retry following the given
+// attempt: a random duration up to an exponentially growing bound.
+func retryBackoff(attempt int) time.Duration {
+	d := retryMaxBackoff
+	if attempt < 10 {
+		d = min(retryMinBackoff<<attempt, retryMaxBackoff)
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryAfter returns the delay requested by the Retry-After header of the
+// response, if any.
+func retryAfter(response *http.Response) (time.Duration, bool) {
+	if response == nil {
+		return 0, false
+	}
+	v := response.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// temporaryFailure reports whether an upload failed because the agent could
+// not be reached or was temporarily unable to handle it. Such uploads are
+// retried, and spooled if a spool is set up.
+func temporaryFailure(response *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, errOldAgent)
+	}
+	return response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+}
+
+// send sends the request to the agent once. The responses of the agents too
+// old to take profiles are logged and turned into errOldAgent.
+func (t *bfTransport) send(req *http.Request) (*http.Response, error) {
+	response, err := t.roundTrip(req)
 	if err != nil {
 		if strings.Contains(err.Error(), "malformed HTTP version") {
 			log.Error().Str("endpoint", req.URL.String()).Err(err).Msg("failed to send request")
@@ -52,5 +355,150 @@ func (t *bfTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		return response, errOldAgent
 	}
 
+	return response, nil
+}
+
+// roundTrip sends the request to the agent once, with the credentials.
+func (t *bfTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.scheme != "" && req.URL.Scheme != t.scheme {
+		// The backends always build http:// URLs.
+		req = req.Clone(req.Context())
+		req.URL.Scheme = t.scheme
+	}
+	serverId, serverToken := t.serverId, t.serverToken
+	if t.credentials != nil {
+		var err error
+		serverId, serverToken, err = t.credentials.get(req.Context())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if serverId != "" && serverToken != "" {
+		req.SetBasicAuth(serverId, serverToken)
+	}
+
+	response, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return response, err
+	}
+
+	if t.credentials != nil && (response.StatusCode == 401 || response.StatusCode == 403) {
+		t.credentials.invalidate()
+	}
+
+	return response, nil
+}
+
+// flushTransport wraps the transport and the exporter handed to the backend.
+// It lets Stop follow the uploads of the final period and abort them once the
+// stop deadline is exceeded.
+type flushTransport struct {
+	Transport http.RoundTripper
+	Exporter  Exporter
+
+	mu          sync.Mutex
+	abort       context.Context
+	cancelAbort context.CancelFunc
+	flushing    bool
+	flushErr    error
+
+	uploaded chan struct{} // receives when an upload completes
+}
+
+func newFlushTransport(t http.RoundTripper, e Exporter) *flushTransport {
+	f := &flushTransport{Transport: t, Exporter: e, uploaded: make(chan struct{}, 1)}
+	f.reset()
+	return f
+}
+
+func (t *flushTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var response *http.Response
+	var err error
+	dropped := t.follow(req.Context(), func(ctx context.Context) error {
+		response, err = t.Transport.RoundTrip(req.WithContext(ctx))
+		if err == nil && (response.StatusCode < 200 || response.StatusCode > 299) {
+			return fmt.Errorf("got %d response", response.StatusCode)
+		}
+		return err
+	})
+	if dropped {
+		// Stopping without waiting for the upload: drop it quietly, the
+		// backend would log an error otherwise.
+		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+	}
 	return response, err
 }
+
+func (t *flushTransport) Export(ctx context.Context, b Batch) error {
+	var err error
+	t.follow(ctx, func(ctx context.Context) error {
+		err = t.Exporter.Export(ctx, b)
+		return err
+	})
+	return err
+}
+
+// follow runs upload with a context cancelled by abortUploads, recording its
+// outcome while flushing. It reports true if the upload was dropped instead.
+func (t *flushTransport) follow(ctx context.Context, upload func(ctx context.Context) error) bool {
+	t.mu.Lock()
+	abort := t.abort
+	t.mu.Unlock()
+
+	if abort.Err() != nil {
+		return true
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(abort, cancel)
+	defer stop()
+
+	err := upload(ctx)
+
+	select {
+	case t.uploaded <- struct{}{}:
+	default:
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.flushing {
+		t.flushErr = err
+	}
+	return false
+}
+
+// abortUploads aborts the pending uploads and drops the next ones, until reset.
+func (t *flushTransport) abortUploads() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.cancelAbort()
+}
+
+// reset lets uploads through again and stops recording their outcome.
+func (t *flushTransport) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.abort, t.cancelAbort = context.WithCancel(context.Background())
+	t.flushing = false
+	t.flushErr = nil
+}
+
+// beginFlush starts recording the outcome of the uploads.
+func (t *flushTransport) beginFlush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.flushing = true
+}
+
+// err returns the error of the last upload since beginFlush.
+func (t *flushTransport) err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.flushErr
+}
@@ -0,0 +1,158 @@
+package profiler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T, m *mockTransport, opts ...Option) *http.Client {
+	cfg, err := newProfilerConfig(append([]Option{withTransport(m)}, opts...)...)
+	require.Nil(t, err)
+
+	bt, err := newBFTransport(cfg, "unix", "/tmp/agent.sock")
+	require.Nil(t, err)
+	return &http.Client{Transport: bt}
+}
+
+func TestRetries(t *testing.T) {
+	t.Run("temporary failures", func(t *testing.T) {
+		var bodies []string
+		m := &mockTransport{}
+		m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+			body, _ := io.ReadAll(req.Body)
+			bodies = append(bodies, string(body))
+			switch len(bodies) {
+			case 1:
+				return nil, errors.New("connect: connection refused")
+			case 2:
+				return &http.Response{StatusCode: 503, Header: http.Header{"Retry-After": {"0"}}, Body: http.NoBody}, nil
+			default:
+				return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+			}
+		}
+		h := newTestClient(t, m, WithUploadRetries(2))
+
+		resp, err := h.Post("http://localhost/profiling/v1/input", "text/plain", strings.NewReader("profile"))
+		require.Nil(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		require.Equal(t, []string{"profile", "profile", "profile"}, bodies)
+	})
+
+	t.Run("max retries", func(t *testing.T) {
+		attempts := 0
+		m := &mockTransport{}
+		m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return &http.Response{StatusCode: 429, Header: http.Header{"Retry-After": {"0"}}, Body: http.NoBody}, nil
+		}
+		h := newTestClient(t, m, WithUploadRetries(3))
+
+		resp, err := h.Post("http://localhost/profiling/v1/input", "text/plain", strings.NewReader("profile"))
+		require.Nil(t, err)
+		require.Equal(t, 429, resp.StatusCode)
+		require.Equal(t, 4, attempts)
+	})
+
+	t.Run("upload timeout", func(t *testing.T) {
+		attempts := 0
+		m := &mockTransport{}
+		m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return &http.Response{StatusCode: 503, Header: http.Header{"Retry-After": {"1"}}, Body: http.NoBody}, nil
+		}
+		h := newTestClient(t, m, WithUploadRetries(3), WithUploadTimeout(100*time.Millisecond))
+
+		resp, err := h.Post("http://localhost/profiling/v1/input", "text/plain", strings.NewReader("profile"))
+		require.Nil(t, err)
+		require.Equal(t, 503, resp.StatusCode)
+		require.Equal(t, 1, attempts)
+	})
+
+	t.Run("old agent", func(t *testing.T) {
+		attempts := 0
+		m := &mockTransport{}
+		m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return &http.Response{StatusCode: 404, Body: http.NoBody}, nil
+		}
+		h := newTestClient(t, m, WithUploadRetries(3))
+
+		_, err := h.Post("http://localhost/profiling/v1/input", "text/plain", strings.NewReader("profile"))
+		require.ErrorIs(t, err, errOldAgent)
+		require.Equal(t, 1, attempts)
+	})
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for attempt, max := range []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		for range 10 {
+			d := retryBackoff(attempt)
+			require.GreaterOrEqual(t, d, max/2)
+			require.LessOrEqual(t, d, max)
+		}
+	}
+	require.LessOrEqual(t, retryBackoff(100), retryMaxBackoff)
+}
+
+func TestProxy(t *testing.T) {
+	var requests []*http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		w.WriteHeader(200)
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	require.Nil(t, err)
+	proxyURL.User = url.UserPassword("user", "secret")
+
+	cfg, err := newProfilerConfig(WithProxy(proxyURL.String()), WithUploadRetries(0))
+	require.Nil(t, err)
+	bt, err := newBFTransport(cfg, "tcp", "agent.example:8307")
+	require.Nil(t, err)
+	h := &http.Client{Transport: bt}
+
+	resp, err := h.Post("http://agent.example:8307/profiling/v1/input", "text/plain", strings.NewReader("profile"))
+	require.Nil(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Len(t, requests, 1)
+	require.Equal(t, "agent.example:8307", requests[0].URL.Host)
+	require.Equal(t, "Basic dXNlcjpzZWNyZXQ=", requests[0].Header.Get("Proxy-Authorization"))
+
+	// Unix sockets bypass the proxy
+	bt, err = newBFTransport(cfg, "unix", "/tmp/agent.sock")
+	require.Nil(t, err)
+	require.Nil(t, bt.Transport.(*http.Transport).Proxy)
+
+	_, err = newProfilerConfig(WithProxy("ftp://proxy:21"))
+	require.ErrorContains(t, err, `unsupported proxy scheme "ftp"`)
+}
+
+func TestTransportSettings(t *testing.T) {
+	cfg, err := newProfilerConfig(WithConnectTimeout(time.Second), WithMaxIdleConns(0), WithIdleConnTimeout(time.Minute))
+	require.Nil(t, err)
+	tr := newTransport("unix", filepath.Join(t.TempDir(), "agent.sock"), cfg)
+	require.Equal(t, time.Second, tr.TLSHandshakeTimeout)
+	require.True(t, tr.DisableKeepAlives)
+	require.Equal(t, time.Minute, tr.IdleConnTimeout)
+
+	// Dialing stops with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tr.DialContext(ctx, "tcp", "localhost:8307")
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = newProfilerConfig(WithConnectTimeout(0), WithMaxIdleConns(-1))
+	require.ErrorContains(t, err, "connect timeout must be positive")
+	require.ErrorContains(t, err, "max idle connections must not be negative")
+}
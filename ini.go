@@ -0,0 +1,94 @@
+package profiler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// iniFile holds the values of an INI file, by section then key. Keys outside
+// of any section are in the "" section. Section and key names are lower case.
+type iniFile map[string]map[string]string
+
+// parseINI parses the INI files written by the Blackfire CLI and probes.
+// Malformed lines are ignored.
+func parseINI(r io.Reader) (iniFile, error) {
+	ini := iniFile{"": {}}
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if ini[section] == nil {
+				ini[section] = map[string]string{}
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		ini[section][strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return ini, scanner.Err()
+}
+
+// get returns the value of key in the [blackfire] section, or outside of any
+// section.
+func (ini iniFile) get(key string) string {
+	if v, ok := ini["blackfire"][key]; ok {
+		return v
+	}
+	return ini[""][key]
+}
+
+// blackfireINIPath returns the path of the Blackfire configuration file shared
+// with the CLI and the other probes: BLACKFIRE_CONFIG, or ~/.blackfire.ini.
+// explicit reports whether the path was set through BLACKFIRE_CONFIG.
+func blackfireINIPath() (path string, explicit bool) {
+	if v := os.Getenv("BLACKFIRE_CONFIG"); v != "" {
+		return v, true
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(home, ".blackfire.ini"), false
+}
+
+// readBlackfireINI reads the Blackfire configuration file. A missing
+// ~/.blackfire.ini is not an error, a missing BLACKFIRE_CONFIG file is.
+func readBlackfireINI() (iniFile, error) {
+	path, explicit := blackfireINIPath()
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not read Blackfire configuration file: %w", err)
+	}
+	defer f.Close()
+
+	ini, err := parseINI(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not read Blackfire configuration file %s: %w", path, err)
+	}
+	return ini, nil
+}
@@ -10,7 +10,6 @@ import (
 	"time"
 
 	"github.com/rs/zerolog"
-	dd_trace "github.com/DataDog/dd-trace-go/v2/ddtrace/tracer"
 )
 
 const (
@@ -40,7 +39,7 @@ func logLevel(v int) zerolog.Level {
 
 func setGlobalLogger(logger zerolog.Logger) {
 	log = logger
-	dd_trace.UseLogger(NewDataDogLoggerBridge(log))
+	setBackendLogger(log)
 
 }
 
@@ -0,0 +1,181 @@
+package profiler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+)
+
+// FailureReason classifies the failed uploads counted in ProfilerMetrics.
+type FailureReason string
+
+const (
+	// FailureOldAgent is an agent too old to accept profiles.
+	FailureOldAgent FailureReason = "old_agent"
+	// FailureNotFound is a 404 response.
+	FailureNotFound FailureReason = "not_found"
+	// FailureTimeout is an upload that timed out.
+	FailureTimeout FailureReason = "timeout"
+	// FailureConnectionRefused is an agent not listening on its socket, or
+	// a missing unix socket.
+	FailureConnectionRefused FailureReason = "connection_refused"
+	// FailureStatus is any other non-2xx response.
+	FailureStatus FailureReason = "status"
+	// FailureOther is any other error.
+	FailureOther FailureReason = "other"
+)
+
+// FailureReasons lists the reasons of failed uploads.
+var FailureReasons = []FailureReason{
+	FailureOldAgent,
+	FailureNotFound,
+	FailureTimeout,
+	FailureConnectionRefused,
+	FailureStatus,
+	FailureOther,
+}
+
+// The upper bounds of the histogram buckets.
+var (
+	payloadSizeBuckets    = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+	uploadDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// ProfilerMetrics are the self-metrics of the profilers of the process, as
+// returned by Metrics. Importing the expvar package of this module publishes
+// them with expvar as "blackfire_conprof".
+type ProfilerMetrics struct {
+	// Uploads counts the successful uploads, Failures the failed ones by
+	// reason.
+	Uploads  uint64                   `json:"uploads"`
+	Failures map[FailureReason]uint64 `json:"failures"`
+	// PayloadSize is the size of the uploads in bytes, and UploadDuration
+	// their duration in seconds, retries included.
+	PayloadSize    Histogram `json:"payload_size_bytes"`
+	UploadDuration Histogram `json:"upload_duration_seconds"`
+}
+
+// Histogram is a distribution of observations.
+type Histogram struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+	// Buckets are sorted by upper bound, their counts are cumulative.
+	Buckets []Bucket `json:"buckets"`
+}
+
+// Bucket counts the observations less than or equal to UpperBound.
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      uint64  `json:"count"`
+}
+
+// histogram records observations in fixed buckets.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // by bucket, the last one for the observations above all bounds
+	sum    float64
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *histogram) export() Histogram {
+	e := Histogram{Sum: h.sum, Buckets: make([]Bucket, len(h.bounds))}
+	for i, bound := range h.bounds {
+		e.Count += h.counts[i]
+		e.Buckets[i] = Bucket{UpperBound: bound, Count: e.Count}
+	}
+	e.Count += h.counts[len(h.bounds)]
+	return e
+}
+
+// uploadMetrics records the uploads of all the profilers of the process.
+type uploadMetrics struct {
+	mu             sync.Mutex
+	uploads        uint64
+	failures       map[FailureReason]uint64
+	payloadSize    histogram
+	uploadDuration histogram
+}
+
+var metrics = newUploadMetrics()
+
+func newUploadMetrics() *uploadMetrics {
+	return &uploadMetrics{
+		failures:       make(map[FailureReason]uint64),
+		payloadSize:    newHistogram(payloadSizeBuckets),
+		uploadDuration: newHistogram(uploadDurationBuckets),
+	}
+}
+
+// record records an upload.
+func (m *uploadMetrics) record(r uploadResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r.bytes > 0 {
+		m.payloadSize.observe(float64(r.bytes))
+	}
+	m.uploadDuration.observe(r.latency.Seconds())
+	if r.reason != "" {
+		m.failures[r.reason]++
+		return
+	}
+	m.uploads++
+}
+
+func (m *uploadMetrics) export() ProfilerMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := ProfilerMetrics{
+		Uploads:        m.uploads,
+		Failures:       make(map[FailureReason]uint64, len(FailureReasons)),
+		PayloadSize:    m.payloadSize.export(),
+		UploadDuration: m.uploadDuration.export(),
+	}
+	for _, reason := range FailureReasons {
+		e.Failures[reason] = m.failures[reason]
+	}
+	return e
+}
+
+// failureReason classifies the outcome of an upload, reporting false when it
+// succeeded.
+func failureReason(response *http.Response, err error) (FailureReason, bool) {
+	var netErr net.Error
+	switch {
+	case response != nil && response.StatusCode == http.StatusNotFound:
+		return FailureNotFound, true
+	case errors.Is(err, errOldAgent):
+		return FailureOldAgent, true
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return FailureTimeout, true
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ENOENT):
+		return FailureConnectionRefused, true
+	case err != nil:
+		return FailureOther, true
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return FailureStatus, true
+	}
+	return "", false
+}
+
+// Metrics returns the self-metrics of the profilers of the process, since it
+// started.
+func Metrics() ProfilerMetrics {
+	return metrics.export()
+}
@@ -0,0 +1,96 @@
+package profiler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureReason(t *testing.T) {
+	// A port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	tr := &bfTransport{Transport: &http.Transport{}}
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+agentUploadPath, http.NoBody)
+	require.Nil(t, err)
+	_, refused := tr.send(req)
+	require.NotNil(t, refused)
+	_, missing := net.Dial("unix", filepath.Join(t.TempDir(), "agent.sock"))
+	require.NotNil(t, missing)
+
+	for _, tt := range []struct {
+		status int
+		err    error
+		reason FailureReason
+		failed bool
+	}{
+		{status: 200},
+		{status: 202},
+		{status: 404, err: errOldAgent, reason: FailureNotFound, failed: true},
+		{err: errOldAgent, reason: FailureOldAgent, failed: true},
+		{err: fmt.Errorf("upload: %w", context.DeadlineExceeded), reason: FailureTimeout, failed: true},
+		{err: &net.OpError{Op: "dial", Err: timeoutError{}}, reason: FailureTimeout, failed: true},
+		{err: refused, reason: FailureConnectionRefused, failed: true},
+		{err: missing, reason: FailureConnectionRefused, failed: true},
+		{err: errors.New("boom"), reason: FailureOther, failed: true},
+		{status: 500, reason: FailureStatus, failed: true},
+	} {
+		var response *http.Response
+		if tt.status != 0 {
+			response = &http.Response{StatusCode: tt.status}
+		}
+		reason, failed := failureReason(response, tt.err)
+		require.Equal(t, tt.failed, failed, "%d %v", tt.status, tt.err)
+		require.Equal(t, tt.reason, reason, "%d %v", tt.status, tt.err)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestUploadMetrics(t *testing.T) {
+	m := newUploadMetrics()
+	req, err := http.NewRequest(http.MethodPost, "http://agent"+agentUploadPath, http.NoBody)
+	require.Nil(t, err)
+
+	req.ContentLength = 2000
+	record := func(response *http.Response, err error, latency time.Duration) {
+		if r, ok := newUploadResult(req, response, err, latency); ok {
+			m.record(r)
+		}
+	}
+	record(&http.Response{StatusCode: 200}, nil, 30*time.Millisecond)
+	req.ContentLength = 100 << 20
+	record(&http.Response{StatusCode: 200}, nil, 2*time.Second)
+	record(&http.Response{StatusCode: 404}, errOldAgent, time.Second)
+	record(nil, context.Canceled, time.Second)
+
+	e := m.export()
+	require.Equal(t, uint64(2), e.Uploads)
+	require.Equal(t, uint64(1), e.Failures[FailureNotFound])
+	require.Equal(t, uint64(0), e.Failures[FailureTimeout])
+	require.Len(t, e.Failures, len(FailureReasons))
+
+	require.Equal(t, uint64(3), e.PayloadSize.Count)
+	require.Equal(t, float64(2000+200<<20), e.PayloadSize.Sum)
+	require.Equal(t, Bucket{UpperBound: 1 << 10, Count: 0}, e.PayloadSize.Buckets[0])
+	require.Equal(t, Bucket{UpperBound: 4 << 10, Count: 1}, e.PayloadSize.Buckets[1])
+	require.Equal(t, uint64(1), e.PayloadSize.Buckets[len(e.PayloadSize.Buckets)-1].Count)
+
+	require.Equal(t, uint64(3), e.UploadDuration.Count)
+	require.InDelta(t, 3.03, e.UploadDuration.Sum, 1e-9)
+	require.Equal(t, Bucket{UpperBound: 0.05, Count: 1}, e.UploadDuration.Buckets[0])
+	require.Equal(t, Bucket{UpperBound: 2.5, Count: 3}, e.UploadDuration.Buckets[5])
+}
@@ -0,0 +1,341 @@
+package profiler
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"time"
+
+	pprof_profile "github.com/google/pprof/profile"
+)
+
+// nativeQueueSize is the number of batches waiting for their upload before
+// the oldest one is dropped.
+const nativeQueueSize = 2
+
+// nativeBackend collects the profiles with runtime/pprof and hands them to an
+// Exporter.
+type nativeBackend struct {
+	exit chan struct{} // closed by stop
+	done chan struct{} // closed once the final profiles are exported
+}
+
+func (b *nativeBackend) start(cfg *config, agentAddr string, client *http.Client, exporter Exporter) error {
+	if b.exit != nil {
+		b.stop()
+	}
+	c, err := newNativeCollector(cfg, exporter)
+	if err != nil {
+		return err
+	}
+	b.exit = make(chan struct{})
+	b.done = make(chan struct{})
+	go func(exit, done chan struct{}) {
+		defer close(done)
+		c.run(exit)
+	}(b.exit, b.done)
+	return nil
+}
+
+func (b *nativeBackend) stop() {
+	if b.exit == nil {
+		return
+	}
+	close(b.exit)
+	<-b.done
+	b.exit, b.done = nil, nil
+}
+
+// nativeProfile describes how a profile is collected and uploaded.
+type nativeProfile struct {
+	types    []ProfileType // enabling the profile
+	name     string        // for pprof.Lookup
+	filename string        // of the upload
+	// sampleTypes are the sample types uploaded, all of them when empty.
+	sampleTypes []string
+	// deltas are the sample types that add up since the process started,
+	// uploaded as the difference with the previous period. The other ones
+	// are uploaded as is.
+	deltas []string
+}
+
+// nativeProfiles are the profiles collected at the end of a period, in upload
+// order, after the CPU profile.
+var nativeProfiles = []nativeProfile{
+	{
+		types:       []ProfileType{HeapProfile},
+		name:        "heap",
+		filename:    "delta-heap.pprof",
+		sampleTypes: []string{"inuse_objects", "inuse_space"},
+	},
+	{
+		types:       []ProfileType{AllocationProfile},
+		name:        "heap",
+		filename:    "delta-alloc.pprof",
+		sampleTypes: []string{"alloc_objects", "alloc_space"},
+		deltas:      []string{"alloc_objects", "alloc_space"},
+	},
+	{
+		types:    []ProfileType{BlockProfile},
+		name:     "block",
+		filename: "delta-block.pprof",
+		deltas:   []string{"contentions", "delay"},
+	},
+	{
+		types:    []ProfileType{MutexProfile},
+		name:     "mutex",
+		filename: "delta-mutex.pprof",
+		deltas:   []string{"contentions", "delay"},
+	},
+	{
+		types:    []ProfileType{GoroutineProfile},
+		name:     "goroutine",
+		filename: "goroutines.pprof",
+	},
+}
+
+// nativeCollector collects the profiles of cfg every period and exports them.
+type nativeCollector struct {
+	cfg      *config
+	exporter Exporter
+
+	profiles []nativeProfile
+	previous map[string]*pprof_profile.Profile // by filename, for the deltas
+	seq      int
+}
+
+func newNativeCollector(cfg *config, exporter Exporter) (*nativeCollector, error) {
+	c := &nativeCollector{
+		cfg:      cfg,
+		exporter: exporter,
+		previous: make(map[string]*pprof_profile.Profile),
+	}
+
+	if slices.Contains(cfg.types, BlockProfile) {
+		runtime.SetBlockProfileRate(cfg.blockRate)
+	}
+	if slices.Contains(cfg.types, MutexProfile) {
+		runtime.SetMutexProfileFraction(cfg.mutexFraction)
+	}
+	for _, p := range nativeProfiles {
+		if !slices.ContainsFunc(p.types, func(t ProfileType) bool { return slices.Contains(cfg.types, t) }) {
+			continue
+		}
+		c.profiles = append(c.profiles, p)
+		if len(p.deltas) > 0 {
+			// The first period is the difference with the start.
+			prof, err := lookupProfile(p.name)
+			if err != nil {
+				return nil, err
+			}
+			c.previous[p.filename] = prof
+		}
+	}
+	return c, nil
+}
+
+// run collects the profiles at the end of every period until exit is closed,
+// and the partial period then. They are exported in another goroutine, so
+// that a slow upload doesn't delay the next period. run returns once they are
+// all exported.
+func (c *nativeCollector) run(exit chan struct{}) {
+	queue := make(chan Batch, nativeQueueSize)
+	exported := make(chan struct{})
+	go func() {
+		defer close(exported)
+		for b := range queue {
+			c.export(b)
+		}
+	}()
+	defer func() {
+		close(queue)
+		<-exported
+	}()
+
+	for {
+		start := time.Now()
+		stopped := interruptibleSleep(exit, c.cfg.period-c.cfg.cpuDuration)
+
+		// The CPU profile covers the end of the period, so that it records
+		// the collection of the other profiles.
+		var cpu bytes.Buffer
+		cpuStarted := false
+		if slices.Contains(c.cfg.types, CPUProfile) {
+			if c.cfg.cpuProfileRate != 0 {
+				// Must be set before each start, otherwise StartCPUProfile
+				// sets its own rate.
+				runtime.SetCPUProfileRate(c.cfg.cpuProfileRate)
+			}
+			if err := pprof.StartCPUProfile(&cpu); err != nil {
+				log.Error().Err(err).Msg("could not start the CPU profile")
+			} else {
+				cpuStarted = true
+			}
+		}
+		if !stopped {
+			stopped = interruptibleSleep(exit, c.cfg.cpuDuration)
+		}
+
+		profiles := c.collect()
+		if cpuStarted {
+			pprof.StopCPUProfile()
+			profiles = append([]ProfileData{{Name: "cpu.pprof", Data: cpu.Bytes()}}, profiles...)
+		}
+
+		if len(profiles) > 0 {
+			c.enqueue(queue, Batch{
+				Start:    start,
+				End:      time.Now(),
+				Seq:      c.seq,
+				Labels:   maps.Clone(c.cfg.labels),
+				Profiles: profiles,
+			})
+			c.seq++
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// collect returns the profiles other than CPU.
+func (c *nativeCollector) collect() []ProfileData {
+	var profiles []ProfileData
+	for _, p := range c.profiles {
+		prof, err := lookupProfile(p.name)
+		if err == nil && len(p.deltas) > 0 {
+			previous := c.previous[p.filename]
+			c.previous[p.filename] = prof
+			prof, err = deltaProfile(previous, prof, p.deltas)
+		}
+		if err == nil && len(p.sampleTypes) > 0 {
+			prof = keepSampleTypes(prof, p.sampleTypes)
+		}
+		var buf bytes.Buffer
+		if err == nil {
+			err = prof.Write(&buf)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("profile", p.name).Msg("could not collect profile")
+			continue
+		}
+		profiles = append(profiles, ProfileData{Name: p.filename, Data: buf.Bytes()})
+	}
+	return profiles
+}
+
+// lookupProfile returns the runtime/pprof profile named name.
+func lookupProfile(name string) (*pprof_profile.Profile, error) {
+	var buf bytes.Buffer
+	if err := pprof.Lookup(name).WriteTo(&buf, 0); err != nil {
+		return nil, err
+	}
+	return pprof_profile.Parse(&buf)
+}
+
+// deltaProfile returns current with the deltas sample types reduced to their
+// increase since previous.
+func deltaProfile(previous, current *pprof_profile.Profile, deltas []string) (*pprof_profile.Profile, error) {
+	ratios := make([]float64, len(previous.SampleType))
+	for i, st := range previous.SampleType {
+		if slices.Contains(deltas, st.Type) {
+			ratios[i] = -1
+		}
+	}
+	negated := previous.Copy()
+	if err := negated.ScaleN(ratios); err != nil {
+		return nil, err
+	}
+	delta, err := pprof_profile.Merge([]*pprof_profile.Profile{current, negated})
+	if err != nil {
+		return nil, err
+	}
+	delta.TimeNanos = previous.TimeNanos
+	delta.DurationNanos = current.TimeNanos - previous.TimeNanos
+	return delta, nil
+}
+
+// enqueue queues b, dropping the oldest queued batch if the uploads are
+// behind.
+func (c *nativeCollector) enqueue(queue chan Batch, b Batch) {
+	for {
+		select {
+		case queue <- b:
+			return
+		default:
+		}
+		select {
+		case dropped := <-queue:
+			log.Error().Time("start", dropped.Start).Msg("upload is too slow - profile dropped")
+		default:
+		}
+	}
+}
+
+// keepSampleTypes returns prof with only the given sample types, without the
+// samples left with no value.
+func keepSampleTypes(prof *pprof_profile.Profile, types []string) *pprof_profile.Profile {
+	prof = prof.Copy()
+	var (
+		indices     []int
+		sampleTypes []*pprof_profile.ValueType
+	)
+	for i, st := range prof.SampleType {
+		if slices.Contains(types, st.Type) {
+			indices = append(indices, i)
+			sampleTypes = append(sampleTypes, st)
+		}
+	}
+	prof.SampleType = sampleTypes
+	if !slices.Contains(types, prof.DefaultSampleType) {
+		prof.DefaultSampleType = ""
+	}
+
+	samples := prof.Sample[:0]
+	for _, s := range prof.Sample {
+		values := make([]int64, len(indices))
+		for j, i := range indices {
+			values[j] = s.Value[i]
+		}
+		if slices.ContainsFunc(values, func(v int64) bool { return v != 0 }) {
+			s.Value = values
+			samples = append(samples, s)
+		}
+	}
+	prof.Sample = samples
+	return prof.Compact()
+}
+
+// export hands the batch to the exporter, within the upload timeout.
+func (c *nativeCollector) export(b Batch) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.uploadTimeout)
+	defer cancel()
+
+	if err := c.exporter.Export(ctx, b); err != nil {
+		log.Error().Err(err).Msg("failed to upload profile")
+	}
+}
+
+// interruptibleSleep waits for d, and reports whether exit was closed first.
+func interruptibleSleep(exit chan struct{}, d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-exit:
+			return true
+		default:
+			return false
+		}
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-exit:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,223 @@
+package profiler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	pprof_profile "github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeltaProfile(t *testing.T) {
+	fn := &pprof_profile.Function{ID: 1, Name: "main.alloc"}
+	loc := &pprof_profile.Location{ID: 1, Line: []pprof_profile.Line{{Function: fn}}}
+	heap := func(timeNanos, allocs, inuse int64) *pprof_profile.Profile {
+		return &pprof_profile.Profile{
+			SampleType: []*pprof_profile.ValueType{
+				{Type: "alloc_space", Unit: "bytes"},
+				{Type: "inuse_space", Unit: "bytes"},
+			},
+			PeriodType: &pprof_profile.ValueType{Type: "space", Unit: "bytes"},
+			Sample:     []*pprof_profile.Sample{{Location: []*pprof_profile.Location{loc}, Value: []int64{allocs, inuse}}},
+			Location:   []*pprof_profile.Location{loc},
+			Function:   []*pprof_profile.Function{fn},
+			TimeNanos:  timeNanos,
+		}
+	}
+
+	delta, err := deltaProfile(heap(1e9, 100, 40), heap(3e9, 250, 30), []string{"alloc_space"})
+	require.Nil(t, err)
+	require.Nil(t, delta.CheckValid())
+	require.Len(t, delta.Sample, 1)
+	require.Equal(t, []int64{150, 30}, delta.Sample[0].Value)
+	require.Equal(t, int64(1e9), delta.TimeNanos)
+	require.Equal(t, int64(2e9), delta.DurationNanos)
+
+	// Nothing allocated nor in use: the sample is dropped
+	delta, err = deltaProfile(heap(1e9, 100, 40), heap(3e9, 100, 0), []string{"alloc_space"})
+	require.Nil(t, err)
+	require.Len(t, delta.Sample, 0)
+}
+
+func TestNativeBackend(t *testing.T) {
+	uploads := make(chan *http.Request, 10)
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		uploads <- req
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+
+	p, err := New(period(200*time.Millisecond),
+		withTransport(m),
+		WithBackend(NativeBackend),
+		WithLabels(map[string]string{"k1": "v1"}),
+		WithProfileTypes(CPUProfile, HeapProfile, AllocationProfile, GoroutineProfile, BlockProfile, MutexProfile))
+	require.Nil(t, err)
+	require.Nil(t, p.Start(context.Background()))
+	defer p.Stop(context.Background())
+
+	var previousEnd time.Time
+	for seq := range 2 {
+		var req *http.Request
+		select {
+		case req = <-uploads:
+		case <-time.After(5 * time.Second):
+			t.Fatal("test timeouted")
+		}
+		require.Equal(t, http.MethodPost, req.Method)
+		require.Equal(t, agentUploadPath, req.URL.Path)
+
+		reader, err := req.MultipartReader()
+		require.Nil(t, err)
+		var (
+			files []string
+			event uploadEvent
+		)
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			require.Nil(t, err)
+			body, err := io.ReadAll(part)
+			require.Nil(t, err)
+			if part.FormName() == "event" {
+				require.Nil(t, json.Unmarshal(body, &event))
+				continue
+			}
+			files = append(files, part.FileName())
+		}
+		expected := []string{"cpu.pprof", "delta-heap.pprof", "delta-alloc.pprof", "delta-block.pprof", "delta-mutex.pprof", "goroutines.pprof"}
+		require.Equal(t, expected, files)
+		require.Equal(t, expected, event.Attachments)
+		require.Equal(t, "go", event.Family)
+		require.Contains(t, strings.Split(event.Tags, ","), "k1:v1")
+		require.Contains(t, strings.Split(event.Tags, ","), fmt.Sprintf("profile_seq:%d", seq))
+
+		start, err := time.Parse(time.RFC3339Nano, event.Start)
+		require.Nil(t, err)
+		end, err := time.Parse(time.RFC3339Nano, event.End)
+		require.Nil(t, err)
+		// The periods follow each other
+		require.True(t, end.After(start))
+		require.False(t, start.Before(previousEnd))
+		previousEnd = end
+	}
+
+	// Stop uploads the partial period, which parses as the uploads of the
+	// DataDog profiler
+	require.Nil(t, p.Stop(context.Background()))
+	require.NotEmpty(t, uploads)
+	var req *http.Request
+	for len(uploads) > 0 {
+		req = <-uploads
+	}
+	_, profiles := parseConProfReq(t, req)
+	require.Len(t, profiles, 6)
+	require.Equal(t, "cpu", profiles[0].SampleType[1].Type)
+	// The in-use memory and the allocations are uploaded apart
+	sampleTypes := func(p *pprof_profile.Profile) []string {
+		var types []string
+		for _, st := range p.SampleType {
+			types = append(types, st.Type)
+		}
+		return types
+	}
+	require.Equal(t, []string{"inuse_objects", "inuse_space"}, sampleTypes(profiles[1]))
+	require.Equal(t, []string{"alloc_objects", "alloc_space"}, sampleTypes(profiles[2]))
+}
+
+func TestKeepSampleTypes(t *testing.T) {
+	fn := &pprof_profile.Function{ID: 1, Name: "main.alloc"}
+	loc := &pprof_profile.Location{ID: 1, Line: []pprof_profile.Line{{Function: fn}}}
+	prof := &pprof_profile.Profile{
+		SampleType: []*pprof_profile.ValueType{
+			{Type: "alloc_space", Unit: "bytes"},
+			{Type: "inuse_space", Unit: "bytes"},
+		},
+		DefaultSampleType: "inuse_space",
+		Sample: []*pprof_profile.Sample{
+			{Location: []*pprof_profile.Location{loc}, Value: []int64{100, 40}},
+			{Location: []*pprof_profile.Location{loc}, Value: []int64{50, 0}},
+		},
+		Location: []*pprof_profile.Location{loc},
+		Function: []*pprof_profile.Function{fn},
+	}
+
+	inuse := keepSampleTypes(prof, []string{"inuse_space"})
+	require.Nil(t, inuse.CheckValid())
+	require.Equal(t, "inuse_space", inuse.DefaultSampleType)
+	require.Len(t, inuse.Sample, 1)
+	require.Equal(t, []int64{40}, inuse.Sample[0].Value)
+
+	allocs := keepSampleTypes(prof, []string{"alloc_space"})
+	require.Equal(t, "", allocs.DefaultSampleType)
+	require.Len(t, allocs.Sample, 1)
+	require.Equal(t, []int64{150}, allocs.Sample[0].Value)
+	// prof is left as is
+	require.Len(t, prof.SampleType, 2)
+}
+
+func TestConfigBackend(t *testing.T) {
+	t.Setenv("BLACKFIRE_CONPROF_BACKEND", "")
+	cfg, err := newProfilerConfig()
+	require.Nil(t, err)
+	require.Equal(t, NativeBackend, cfg.backend)
+
+	t.Setenv("BLACKFIRE_CONPROF_BACKEND", "datadog")
+	cfg, err = newProfilerConfig()
+	if hasDataDogBackend {
+		require.Nil(t, err)
+		require.Equal(t, DataDogBackend, cfg.export().Backend)
+	} else {
+		require.ErrorContains(t, err, "the datadog backend is not available")
+	}
+
+	_, err = newProfilerConfig(WithBackend(Backend(7)))
+	require.ErrorContains(t, err, "unknown backend (7)")
+
+	t.Setenv("BLACKFIRE_CONPROF_BACKEND", "pprof")
+	_, err = newProfilerConfig(WithStrictEnv(true))
+	require.ErrorContains(t, err, `invalid backend in BLACKFIRE_CONPROF_BACKEND: "pprof"`)
+}
+
+func TestNativeBackendSlowUpload(t *testing.T) {
+	release := make(chan struct{})
+	batches := make(chan Batch, 10)
+	p, err := New(period(100*time.Millisecond),
+		WithBackend(NativeBackend),
+		WithProfileTypes(CPUProfile),
+		WithExporter(ExporterFunc(func(ctx context.Context, b Batch) error {
+			if b.Seq == 0 {
+				<-release
+			}
+			batches <- b
+			return nil
+		})))
+	require.Nil(t, err)
+	require.Nil(t, p.Start(context.Background()))
+	defer p.Stop(context.Background())
+
+	// The profiles are still collected while the first upload hangs: the
+	// oldest ones are dropped
+	time.Sleep(600 * time.Millisecond)
+	close(release)
+	var seqs []int
+	for range 3 {
+		select {
+		case b := <-batches:
+			seqs = append(seqs, b.Seq)
+		case <-time.After(5 * time.Second):
+			t.Fatal("test timeouted")
+		}
+	}
+	require.Equal(t, 0, seqs[0])
+	require.Greater(t, seqs[1], 1)
+	require.Equal(t, seqs[1]+1, seqs[2])
+}
@@ -0,0 +1,328 @@
+package otlp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	profiler "github.com/blackfireio/go-continuous-profiling"
+	pprof_profile "github.com/google/pprof/profile"
+	collectorpb "go.opentelemetry.io/proto/slim/otlp/collector/profiles/v1development"
+	commonpb "go.opentelemetry.io/proto/slim/otlp/common/v1"
+	profilespb "go.opentelemetry.io/proto/slim/otlp/profiles/v1development"
+	resourcepb "go.opentelemetry.io/proto/slim/otlp/resource/v1"
+)
+
+const scopeName = "github.com/blackfireio/go-continuous-profiling"
+
+// semanticAttributes are the OpenTelemetry resource attributes set from the
+// profiler labels, by label.
+var semanticAttributes = map[string]string{
+	"application_name": "service.name",
+	"host":             "host.name",
+	"runtime":          "process.runtime.name",
+	"runtime_version":  "process.runtime.version",
+	"runtime_os":       "os.type",
+	"runtime_arch":     "host.arch",
+}
+
+// convert returns the OTLP request exporting the profiles of b.
+func convert(b profiler.Batch) (*collectorpb.ExportProfilesServiceRequest, error) {
+	d := newDictionary()
+	scope := &profilespb.ScopeProfiles{
+		Scope: &commonpb.InstrumentationScope{
+			Name:    scopeName,
+			Version: profiler.Version.String(),
+		},
+	}
+	for _, p := range b.Profiles {
+		if !strings.HasSuffix(p.Name, ".pprof") {
+			// Such as the metrics.json part of the DataDog backend.
+			continue
+		}
+		prof, err := pprof_profile.Parse(bytes.NewReader(p.Data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s profile: %w", p.Name, err)
+		}
+		scope.Profiles = append(scope.Profiles, d.profiles(prof, b)...)
+	}
+
+	return &collectorpb.ExportProfilesServiceRequest{
+		ResourceProfiles: []*profilespb.ResourceProfiles{{
+			Resource:      resource(b.Labels),
+			ScopeProfiles: []*profilespb.ScopeProfiles{scope},
+		}},
+		Dictionary: d.ProfilesDictionary,
+	}, nil
+}
+
+// resource returns the resource described by the profiler labels: each label
+// is an attribute, and the labels having an OpenTelemetry semantic convention
+// are also set under its name.
+func resource(labels map[string]string) *resourcepb.Resource {
+	r := &resourcepb.Resource{}
+	attributes := maps.Clone(labels)
+	for label, attribute := range semanticAttributes {
+		if v, ok := labels[label]; ok {
+			if _, ok := labels[attribute]; !ok {
+				attributes[attribute] = v
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(attributes)) {
+		r.Attributes = append(r.Attributes, &commonpb.KeyValue{
+			Key:   name,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: attributes[name]}},
+		})
+	}
+	return r
+}
+
+// dictionary builds the tables shared by the profiles of a request. The first
+// entry of each table is the zero value, as required by OTLP.
+type dictionary struct {
+	*profilespb.ProfilesDictionary
+
+	strings    map[string]int32
+	mappings   map[mappingKey]int32
+	functions  map[functionKey]int32
+	locations  map[string]int32
+	stacks     map[string]int32
+	attributes map[attributeKey]int32
+}
+
+type mappingKey struct {
+	start, limit, offset uint64
+	file                 string
+}
+
+type functionKey struct {
+	name, systemName, filename string
+	startLine                  int64
+}
+
+type attributeKey struct {
+	key, value, unit string
+	num              int64
+	isNum            bool
+}
+
+func newDictionary() *dictionary {
+	return &dictionary{
+		ProfilesDictionary: &profilespb.ProfilesDictionary{
+			MappingTable:   []*profilespb.Mapping{{}},
+			LocationTable:  []*profilespb.Location{{}},
+			FunctionTable:  []*profilespb.Function{{}},
+			LinkTable:      []*profilespb.Link{{}},
+			StringTable:    []string{""},
+			AttributeTable: []*profilespb.KeyValueAndUnit{{}},
+			StackTable:     []*profilespb.Stack{{}},
+		},
+		strings:    map[string]int32{"": 0},
+		mappings:   map[mappingKey]int32{},
+		functions:  map[functionKey]int32{},
+		locations:  map[string]int32{},
+		stacks:     map[string]int32{},
+		attributes: map[attributeKey]int32{},
+	}
+}
+
+// profiles returns the OTLP profiles of prof, one per sample type.
+func (d *dictionary) profiles(prof *pprof_profile.Profile, b profiler.Batch) []*profilespb.Profile {
+	start, duration := prof.TimeNanos, prof.DurationNanos
+	if start == 0 {
+		start = b.Start.UnixNano()
+	}
+	if duration == 0 {
+		duration = b.End.Sub(b.Start).Nanoseconds()
+	}
+
+	stacks := make([]int32, len(prof.Sample))
+	attributes := make([][]int32, len(prof.Sample))
+	for i, s := range prof.Sample {
+		stacks[i] = d.stack(s.Location)
+		attributes[i] = d.sampleAttributes(s)
+	}
+
+	profiles := make([]*profilespb.Profile, 0, len(prof.SampleType))
+	for i, st := range prof.SampleType {
+		p := &profilespb.Profile{
+			SampleType:   d.valueType(st),
+			TimeUnixNano: uint64(start),
+			DurationNano: uint64(max(duration, 0)),
+			Period:       prof.Period,
+			ProfileId:    profileID(),
+		}
+		if prof.PeriodType != nil {
+			p.PeriodType = d.valueType(prof.PeriodType)
+		}
+		for j, s := range prof.Sample {
+			if s.Value[i] == 0 {
+				continue
+			}
+			p.Samples = append(p.Samples, &profilespb.Sample{
+				StackIndex:       stacks[j],
+				Values:           []int64{s.Value[i]},
+				AttributeIndices: attributes[j],
+			})
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles
+}
+
+func (d *dictionary) valueType(vt *pprof_profile.ValueType) *profilespb.ValueType {
+	return &profilespb.ValueType{
+		TypeStrindex: d.string(vt.Type),
+		UnitStrindex: d.string(vt.Unit),
+	}
+}
+
+func (d *dictionary) string(s string) int32 {
+	if i, ok := d.strings[s]; ok {
+		return i
+	}
+	i := int32(len(d.StringTable))
+	d.StringTable = append(d.StringTable, s)
+	d.strings[s] = i
+	return i
+}
+
+func (d *dictionary) mapping(m *pprof_profile.Mapping) int32 {
+	if m == nil {
+		return 0
+	}
+	key := mappingKey{m.Start, m.Limit, m.Offset, m.File}
+	if i, ok := d.mappings[key]; ok {
+		return i
+	}
+	i := int32(len(d.MappingTable))
+	d.MappingTable = append(d.MappingTable, &profilespb.Mapping{
+		MemoryStart:      m.Start,
+		MemoryLimit:      m.Limit,
+		FileOffset:       m.Offset,
+		FilenameStrindex: d.string(m.File),
+	})
+	d.mappings[key] = i
+	return i
+}
+
+func (d *dictionary) function(f *pprof_profile.Function) int32 {
+	if f == nil {
+		return 0
+	}
+	key := functionKey{f.Name, f.SystemName, f.Filename, f.StartLine}
+	if i, ok := d.functions[key]; ok {
+		return i
+	}
+	i := int32(len(d.FunctionTable))
+	d.FunctionTable = append(d.FunctionTable, &profilespb.Function{
+		NameStrindex:       d.string(f.Name),
+		SystemNameStrindex: d.string(f.SystemName),
+		FilenameStrindex:   d.string(f.Filename),
+		StartLine:          f.StartLine,
+	})
+	d.functions[key] = i
+	return i
+}
+
+func (d *dictionary) location(l *pprof_profile.Location) int32 {
+	loc := &profilespb.Location{
+		MappingIndex: d.mapping(l.Mapping),
+		Address:      l.Address,
+	}
+	for _, line := range l.Line {
+		loc.Lines = append(loc.Lines, &profilespb.Line{
+			FunctionIndex: d.function(line.Function),
+			Line:          line.Line,
+			Column:        line.Column,
+		})
+	}
+
+	key := indicesKey(loc.MappingIndex, int32(loc.Address), int32(loc.Address>>32))
+	for _, line := range loc.Lines {
+		key += indicesKey(line.FunctionIndex, int32(line.Line), int32(line.Column))
+	}
+	if i, ok := d.locations[key]; ok {
+		return i
+	}
+	i := int32(len(d.LocationTable))
+	d.LocationTable = append(d.LocationTable, loc)
+	d.locations[key] = i
+	return i
+}
+
+func (d *dictionary) stack(locations []*pprof_profile.Location) int32 {
+	indices := make([]int32, len(locations))
+	for i, l := range locations {
+		indices[i] = d.location(l)
+	}
+	key := indicesKey(indices...)
+	if i, ok := d.stacks[key]; ok {
+		return i
+	}
+	i := int32(len(d.StackTable))
+	d.StackTable = append(d.StackTable, &profilespb.Stack{LocationIndices: indices})
+	d.stacks[key] = i
+	return i
+}
+
+// sampleAttributes returns the attributes of the pprof labels of s.
+func (d *dictionary) sampleAttributes(s *pprof_profile.Sample) []int32 {
+	var indices []int32
+	for _, key := range slices.Sorted(maps.Keys(s.Label)) {
+		for _, v := range s.Label[key] {
+			indices = append(indices, d.attribute(attributeKey{key: key, value: v}))
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(s.NumLabel)) {
+		units := s.NumUnit[key]
+		for i, v := range s.NumLabel[key] {
+			k := attributeKey{key: key, num: v, isNum: true}
+			if i < len(units) {
+				k.unit = units[i]
+			}
+			indices = append(indices, d.attribute(k))
+		}
+	}
+	return indices
+}
+
+func (d *dictionary) attribute(key attributeKey) int32 {
+	if i, ok := d.attributes[key]; ok {
+		return i
+	}
+	kv := &profilespb.KeyValueAndUnit{
+		KeyStrindex:  d.string(key.key),
+		UnitStrindex: d.string(key.unit),
+	}
+	if key.isNum {
+		kv.Value = &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: key.num}}
+	} else {
+		kv.Value = &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: key.value}}
+	}
+	i := int32(len(d.AttributeTable))
+	d.AttributeTable = append(d.AttributeTable, kv)
+	d.attributes[key] = i
+	return i
+}
+
+// indicesKey returns a map key identifying indices.
+func indicesKey(indices ...int32) string {
+	b := make([]byte, 4*len(indices))
+	for i, v := range indices {
+		binary.LittleEndian.PutUint32(b[4*i:], uint32(v))
+	}
+	return string(b)
+}
+
+// profileID returns a random profile ID.
+func profileID() []byte {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return id
+}
@@ -0,0 +1,211 @@
+// Package otlp exports the profiles of the Blackfire continuous profiler to
+// an OpenTelemetry collector, as OTLP profiles over gRPC or HTTP. It lives in
+// its own module so that the profiler doesn't depend on gRPC and the
+// OpenTelemetry protocol.
+//
+// The OTLP profiles signal is still in development: this package follows the
+// v1development version of the protocol.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	profiler "github.com/blackfireio/go-continuous-profiling"
+	collectorpb "go.opentelemetry.io/proto/slim/otlp/collector/profiles/v1development"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultHTTPPath is the path of the OTLP profiles endpoint of the
+	// collectors, added to the HTTP endpoints without a path.
+	DefaultHTTPPath = "/v1development/profiles"
+
+	grpcExportMethod = "/opentelemetry.proto.collector.profiles.v1development.ProfilesService/Export"
+)
+
+type Option func(*config)
+
+type config struct {
+	headers    map[string]string
+	tlsConfig  *tls.Config
+	insecure   bool
+	httpClient *http.Client
+}
+
+// WithHeaders sets headers sent with each export, such as an API key. They
+// are sent as gRPC metadata over gRPC.
+func WithHeaders(headers map[string]string) Option {
+	return func(cfg *config) {
+		if cfg.headers == nil {
+			cfg.headers = map[string]string{}
+		}
+		for name, value := range headers {
+			cfg.headers[name] = value
+		}
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used to connect to the collector.
+func WithTLSConfig(tc *tls.Config) Option {
+	return func(cfg *config) {
+		cfg.tlsConfig = tc
+	}
+}
+
+// WithInsecure connects to a gRPC collector without TLS. HTTP exporters use
+// TLS depending on the scheme of their endpoint.
+func WithInsecure() Option {
+	return func(cfg *config) {
+		cfg.insecure = true
+	}
+}
+
+// WithHTTPClient sets the client of an HTTP exporter. WithTLSConfig is
+// ignored when it is set.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cfg *config) {
+		cfg.httpClient = c
+	}
+}
+
+// Exporter is a profiler.Exporter sending the profiles to an OpenTelemetry
+// collector. The profiler labels are set as resource attributes, see
+// WithExporter in the profiler package.
+type Exporter struct {
+	headers map[string]string
+
+	// Either an HTTP or a gRPC exporter.
+	client   *http.Client
+	endpoint string
+	conn     *grpc.ClientConn
+}
+
+// NewHTTPExporter returns an exporter posting the profiles to the OTLP/HTTP
+// endpoint of a collector, such as "http://localhost:4318".
+func NewHTTPExporter(endpoint string, opts ...Option) (*Exporter, error) {
+	cfg := newConfig(opts)
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("invalid OTLP endpoint, http:// or https:// expected: %q", endpoint)
+	}
+	if i := strings.Index(endpoint, "://"); !strings.Contains(endpoint[i+3:], "/") {
+		endpoint += DefaultHTTPPath
+	}
+
+	client := cfg.httpClient
+	if client == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = cfg.tlsConfig
+		client = &http.Client{Transport: t}
+	}
+	return &Exporter{headers: cfg.headers, client: client, endpoint: endpoint}, nil
+}
+
+// NewGRPCExporter returns an exporter sending the profiles to the OTLP/gRPC
+// endpoint of a collector, such as "localhost:4317". TLS is used unless
+// WithInsecure is set. Close releases the connection.
+func NewGRPCExporter(target string, opts ...Option) (*Exporter, error) {
+	cfg := newConfig(opts)
+	creds := insecure.NewCredentials()
+	if !cfg.insecure {
+		creds = credentials.NewTLS(cfg.tlsConfig)
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{headers: cfg.headers, conn: conn}, nil
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// Export implements profiler.Exporter.
+func (e *Exporter) Export(ctx context.Context, b profiler.Batch) error {
+	req, err := convert(b)
+	if err != nil {
+		return err
+	}
+	if len(req.ResourceProfiles[0].ScopeProfiles[0].Profiles) == 0 {
+		return nil
+	}
+
+	var response collectorpb.ExportProfilesServiceResponse
+	if e.conn != nil {
+		err = e.exportGRPC(ctx, req, &response)
+	} else {
+		err = e.exportHTTP(ctx, req, &response)
+	}
+	if err != nil {
+		return err
+	}
+	if ps := response.GetPartialSuccess(); ps.GetRejectedProfiles() > 0 {
+		return fmt.Errorf("collector rejected %d profiles: %s", ps.GetRejectedProfiles(), ps.GetErrorMessage())
+	}
+	return nil
+}
+
+func (e *Exporter) exportGRPC(ctx context.Context, req *collectorpb.ExportProfilesServiceRequest, response *collectorpb.ExportProfilesServiceResponse) error {
+	if len(e.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(e.headers))
+	}
+	return e.conn.Invoke(ctx, grpcExportMethod, req, response)
+}
+
+func (e *Exporter) exportHTTP(ctx context.Context, req *collectorpb.ExportProfilesServiceRequest, response *collectorpb.ExportProfilesServiceResponse) error {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range e.headers {
+		r.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got %d response", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != "application/x-protobuf" || len(data) == 0 {
+		return nil
+	}
+	if err := proto.Unmarshal(data, response); err != nil {
+		return errors.New("invalid response of the collector")
+	}
+	return nil
+}
+
+// Close closes the connection of a gRPC exporter.
+func (e *Exporter) Close() error {
+	if e.conn != nil {
+		return e.conn.Close()
+	}
+	return nil
+}
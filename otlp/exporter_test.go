@@ -0,0 +1,188 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	profiler "github.com/blackfireio/go-continuous-profiling"
+	pprof_profile "github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+	collectorpb "go.opentelemetry.io/proto/slim/otlp/collector/profiles/v1development"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+func testBatch(t *testing.T) profiler.Batch {
+	fn := &pprof_profile.Function{ID: 1, Name: "main.work", Filename: "main.go"}
+	loc := &pprof_profile.Location{ID: 1, Address: 0x1000, Line: []pprof_profile.Line{{Function: fn, Line: 12}}}
+	prof := &pprof_profile.Profile{
+		SampleType: []*pprof_profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		PeriodType: &pprof_profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     10000000,
+		Sample: []*pprof_profile.Sample{
+			{Location: []*pprof_profile.Location{loc}, Value: []int64{3, 30000000}, Label: map[string][]string{"endpoint": {"/home"}}},
+			{Location: []*pprof_profile.Location{loc}, Value: []int64{1, 10000000}},
+		},
+		Location: []*pprof_profile.Location{loc},
+		Function: []*pprof_profile.Function{fn},
+	}
+	var buf bytes.Buffer
+	require.Nil(t, prof.Write(&buf))
+
+	return profiler.Batch{
+		Start: time.Unix(1700000000, 0),
+		End:   time.Unix(1700000045, 0),
+		Labels: map[string]string{
+			"application_name": "my-app",
+			"host":             "web-1",
+			"runtime_version":  "go1.25.0",
+		},
+		Profiles: []profiler.ProfileData{
+			{Name: "cpu.pprof", Data: buf.Bytes()},
+			{Name: "metrics.json", Data: []byte("[]")},
+		},
+	}
+}
+
+func checkRequest(t *testing.T, req *collectorpb.ExportProfilesServiceRequest) {
+	require.Len(t, req.ResourceProfiles, 1)
+	attributes := map[string]string{}
+	for _, kv := range req.ResourceProfiles[0].Resource.Attributes {
+		attributes[kv.Key] = kv.Value.GetStringValue()
+	}
+	require.Equal(t, "my-app", attributes["service.name"])
+	require.Equal(t, "my-app", attributes["application_name"])
+	require.Equal(t, "web-1", attributes["host.name"])
+	require.Equal(t, "go1.25.0", attributes["process.runtime.version"])
+
+	d := req.Dictionary
+	require.Equal(t, "", d.StringTable[0])
+	profiles := req.ResourceProfiles[0].ScopeProfiles[0].Profiles
+	// One profile by sample type
+	require.Len(t, profiles, 2)
+	cpu := profiles[1]
+	require.Equal(t, "cpu", d.StringTable[cpu.SampleType.TypeStrindex])
+	require.Equal(t, "nanoseconds", d.StringTable[cpu.SampleType.UnitStrindex])
+	require.Equal(t, uint64(time.Unix(1700000000, 0).UnixNano()), cpu.TimeUnixNano)
+	require.Equal(t, uint64(45*time.Second), cpu.DurationNano)
+	require.Len(t, cpu.Samples, 2)
+	require.Equal(t, []int64{30000000}, cpu.Samples[0].Values)
+
+	stack := d.StackTable[cpu.Samples[0].StackIndex]
+	require.Len(t, stack.LocationIndices, 1)
+	require.Equal(t, cpu.Samples[0].StackIndex, cpu.Samples[1].StackIndex)
+	loc := d.LocationTable[stack.LocationIndices[0]]
+	require.Equal(t, uint64(0x1000), loc.Address)
+	fn := d.FunctionTable[loc.Lines[0].FunctionIndex]
+	require.Equal(t, "main.work", d.StringTable[fn.NameStrindex])
+	require.Equal(t, int64(12), loc.Lines[0].Line)
+
+	require.Len(t, cpu.Samples[0].AttributeIndices, 1)
+	attr := d.AttributeTable[cpu.Samples[0].AttributeIndices[0]]
+	require.Equal(t, "endpoint", d.StringTable[attr.KeyStrindex])
+	require.Equal(t, "/home", attr.Value.GetStringValue())
+}
+
+func TestHTTPExporter(t *testing.T) {
+	var (
+		received *collectorpb.ExportProfilesServiceRequest
+		status   = http.StatusOK
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, DefaultHTTPPath, r.URL.Path)
+		require.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		require.Equal(t, "secret", r.Header.Get("Api-Key"))
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		received = &collectorpb.ExportProfilesServiceRequest{}
+		require.Nil(t, proto.Unmarshal(body, received))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	e, err := NewHTTPExporter(server.URL, WithHeaders(map[string]string{"Api-Key": "secret"}))
+	require.Nil(t, err)
+	require.Nil(t, e.Export(context.Background(), testBatch(t)))
+	checkRequest(t, received)
+
+	status = http.StatusServiceUnavailable
+	require.EqualError(t, e.Export(context.Background(), testBatch(t)), "got 503 response")
+
+	_, err = NewHTTPExporter("localhost:4318")
+	require.ErrorContains(t, err, "invalid OTLP endpoint")
+}
+
+func TestGRPCExporter(t *testing.T) {
+	var (
+		received *collectorpb.ExportProfilesServiceRequest
+		apiKey   []string
+	)
+	server := grpc.NewServer(grpc.UnknownServiceHandler(func(srv any, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		require.Equal(t, grpcExportMethod, method)
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		apiKey = md.Get("api-key")
+		received = &collectorpb.ExportProfilesServiceRequest{}
+		if err := stream.RecvMsg(received); err != nil {
+			return err
+		}
+		return stream.SendMsg(&collectorpb.ExportProfilesServiceResponse{
+			PartialSuccess: &collectorpb.ExportProfilesPartialSuccess{RejectedProfiles: 1, ErrorMessage: "too old"},
+		})
+	}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go server.Serve(l)
+	defer server.Stop()
+
+	e, err := NewGRPCExporter(l.Addr().String(), WithInsecure(), WithHeaders(map[string]string{"Api-Key": "secret"}))
+	require.Nil(t, err)
+	defer e.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.EqualError(t, e.Export(ctx, testBatch(t)), "collector rejected 1 profiles: too old")
+	checkRequest(t, received)
+	require.Equal(t, []string{"secret"}, apiKey)
+}
+
+func TestExporterProfiler(t *testing.T) {
+	received := make(chan *collectorpb.ExportProfilesServiceRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := &collectorpb.ExportProfilesServiceRequest{}
+		if proto.Unmarshal(body, req) == nil {
+			received <- req
+		}
+	}))
+	defer server.Close()
+	// Leave the Blackfire configuration file of the user alone
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("BLACKFIRE_CONFIG", "")
+
+	e, err := NewHTTPExporter(server.URL)
+	require.Nil(t, err)
+	p, err := profiler.New(
+		profiler.WithAppName("my-app"),
+		profiler.WithCPUDuration(100*time.Millisecond),
+		profiler.WithExporter(e))
+	require.Nil(t, err)
+	require.Nil(t, p.Start(context.Background()))
+	require.Nil(t, p.Stop(context.Background()))
+
+	require.NotEmpty(t, received)
+	req := <-received
+	profiles := req.ResourceProfiles[0].ScopeProfiles[0].Profiles
+	require.NotEmpty(t, profiles)
+	require.Equal(t, "samples", req.Dictionary.StringTable[profiles[0].SampleType.TypeStrindex])
+}
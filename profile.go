@@ -10,6 +10,9 @@ const (
 	CPUProfile ProfileType = iota
 	HeapProfile
 	GoroutineProfile
+	BlockProfile
+	MutexProfile
+	AllocationProfile
 )
 
 func (t ProfileType) String() string {
@@ -20,7 +23,34 @@ func (t ProfileType) String() string {
 		return "heap"
 	case GoroutineProfile:
 		return "goroutine"
+	case BlockProfile:
+		return "block"
+	case MutexProfile:
+		return "mutex"
+	case AllocationProfile:
+		return "alloc"
 	default:
 		return fmt.Sprintf("invalid profile type (%d)", int(t))
 	}
 }
+
+// known reports whether t is one of the profile types defined above.
+func (t ProfileType) known() bool {
+	switch t {
+	case CPUProfile, HeapProfile, GoroutineProfile, BlockProfile, MutexProfile, AllocationProfile:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseProfileType returns the profile type named name, as returned by
+// String.
+func parseProfileType(name string) (ProfileType, bool) {
+	for t := CPUProfile; t.known(); t++ {
+		if t.String() == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
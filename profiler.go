@@ -1,23 +1,103 @@
 package profiler
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"regexp"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
-
-	_ "github.com/blackfireio/go-continuous-profiling/bootstrap"
-
-	dd_profiler "github.com/DataDog/dd-trace-go/v2/profiler"
+	"sync/atomic"
+	"time"
 )
 
+const agentUploadPath = "/profiling/v1/input"
+
 var (
 	mu           sync.Mutex
-	activeConfig *config // used for testing
+	running      *Profiler // the profiler owning the collection, guarded by mu
+	activeConfig *config   // used for testing
 	errOldAgent  = errors.New("continuous profiling feature requires Blackfire Agent >= 2.13.0")
+
+	// ErrProfilerRunning is returned by Profiler.Start when another Profiler
+	// is already running. The Go runtime CPU profiler is process wide, so only
+	// one Profiler can run at a time.
+	ErrProfilerRunning = errors.New("another profiler is already running")
+
+	// ErrProfilesDropped is wrapped by the error returned from
+	// Profiler.Stop and StopContext when the profiles of the final period
+	// could not be uploaded.
+	ErrProfilesDropped = errors.New("profiling data was dropped")
+
+	defaultMu       sync.Mutex
+	defaultProfiler *Profiler // used by the package level Start and Stop
+	// defaultStatus is defaultProfiler, read by the package level Status
+	// without waiting for Start and Stop.
+	defaultStatus atomic.Pointer[Profiler]
 )
 
+// Profiler collects profiles and uploads them to the Blackfire Agent
+// periodically. Create one with New.
+type Profiler struct {
+	cfg *config
+
+	// Set by Start.
+	backend    backend
+	agentAddr  string
+	httpClient *http.Client    // used by the backend
+	transport  *bfTransport    // nil when the HTTP client is mocked
+	flush      *flushTransport // follows the uploads made while stopping, also the exporter of the backend
+	fanout     *fanout         // nil when there are no additional destinations
+	probeURL   string
+
+	stopSupervisor context.CancelFunc // nil when there is no circuit breaker
+	supervisor     sync.WaitGroup
+	paused         bool // collection is paused by the circuit breaker, guarded by mu
+
+	base        *config            // the local configuration, without the remote settings, guarded by mu
+	remote      *remoteSettings    // nil when there is no remote configuration, guarded by mu
+	pending     *config            // set by Update until the end of the period, guarded by mu
+	stopUpdater context.CancelFunc // nil when no update is pending
+	updater     sync.WaitGroup
+
+	configURL  string
+	stopPoller context.CancelFunc // nil when the remote configuration is disabled
+	poller     sync.WaitGroup
+
+	// restoreRuntimeRates puts back the runtime profiling rates that were in
+	// place before Start, nil when there is nothing to restore.
+	restoreRuntimeRates func()
+
+	// state is read by Status and Config, which don't take mu: Start and
+	// Stop hold it while waiting for the agent.
+	state atomic.Pointer[profilerState]
+}
+
+// profilerState is the state of a Profiler reported by Status and Config.
+type profilerState struct {
+	running    bool
+	collecting bool
+	config     Config
+	stats      *uploadStats
+}
+
+// publish records the state reported by Status and Config. Must be called
+// with mu held, once the state changed.
+func (p *Profiler) publish() {
+	st := &profilerState{
+		running: running == p,
+		config:  p.cfg.export(),
+	}
+	st.collecting = st.running && p.collecting()
+	if p.transport != nil {
+		st.stats = p.transport.stats
+	}
+	p.state.Store(st)
+}
+
 func parseNetworkAddressString(agentSocket string) (network string, address string, err error) {
 	re := regexp.MustCompile(`^([^:]+)://(.*)`)
 	matches := re.FindAllStringSubmatch(agentSocket, -1)
@@ -30,97 +110,470 @@ func parseNetworkAddressString(agentSocket string) (network string, address stri
 	return
 }
 
+// agentAddress returns the host of the upload URLs for the given agent socket.
+func agentAddress(protocol, address string) (string, error) {
+	switch protocol {
+	case "http", "https", "tcp":
+		return strings.TrimSuffix(address, "/"), nil
+	case "unix":
+		return "localhost", nil
+	default:
+		return "", fmt.Errorf("invalid agent socket protocol: %v", protocol)
+	}
+}
+
 func newProfilerConfig(opts ...Option) (*config, error) {
 	cfg, err := initDefaultConfig()
 	if err != nil {
 		return nil, err
 	}
-	for _, opt := range opts {
-		opt(cfg)
+	cfg.apply(opts)
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
 	}
 
 	return cfg, nil
 }
 
-func Start(opts ...Option) error {
-	mu.Lock()
-	defer mu.Unlock()
-
+// New creates a Profiler from the environment and the given options. The
+// configuration is checked but nothing is collected until Start is called.
+func New(opts ...Option) (*Profiler, error) {
 	cfg, err := newProfilerConfig(opts...)
 	if err != nil {
+		return nil, err
+	}
+	p := &Profiler{cfg: cfg, base: cfg}
+	p.publish()
+	return p, nil
+}
+
+// Config returns the configuration of the profiler.
+func (p *Profiler) Config() Config {
+	return p.state.Load().config.clone()
+}
+
+// Start starts collecting and uploading profiles. It returns
+// ErrProfilerRunning if another Profiler is running.
+func (p *Profiler) Start(ctx context.Context) error {
+	// The agent discovery probes the candidate addresses one after the
+	// other, without mu held. Its result is only used for the configuration
+	// it ran with: it runs again if the configuration changed meanwhile.
+	var (
+		discovered    string
+		discoveredFor *config
+	)
+	for {
+		mu.Lock()
+		cfg := p.cfg
+		if ctx.Err() != nil || running != nil || !cfg.discovery || !cfg.enabled || !cfg.sampled() || cfg == discoveredFor {
+			break
+		}
+		probeCfg := cfg.clone()
+		mu.Unlock()
+		discovered, discoveredFor = discoverAgentSocket(ctx, probeCfg), cfg
+	}
+	defer mu.Unlock()
+	defer p.publish()
+
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	activeConfig = cfg
+	if running == p {
+		return nil
+	}
+	if running != nil {
+		return ErrProfilerRunning
+	}
+	cfg := p.cfg
+
+	if !cfg.enabled {
+		log.Info().Msg("Blackfire continuous profiling is disabled by BLACKFIRE_CONPROF_ENABLED")
+		return nil
+	}
+	if !cfg.sampled() {
+		log.Info().Float64("sample_ratio", cfg.sampleRatio).Str("host", cfg.labels["host"]).Msg("Blackfire continuous profiling is disabled on this host by sampling")
+		return nil
+	}
+
+	if cfg.discovery {
+		cfg.agentSocket = discovered
+		p.base.agentSocket = discovered
+	}
 
 	protocol, address, err := parseNetworkAddressString(cfg.agentSocket)
 	if err != nil {
 		return fmt.Errorf("invalid agent socket. (%s)", cfg.agentSocket)
 	}
 
-	var ddOpts []dd_profiler.Option
-	switch protocol {
-	case "http", "https", "tcp":
-		ddOpts = []dd_profiler.Option{
-			dd_profiler.WithAgentAddr(strings.TrimSuffix(address, "/")),
+	agentAddr, err := agentAddress(protocol, address)
+	if err != nil {
+		return fmt.Errorf("%w [%v]", err, cfg.agentSocket)
+	}
+	p.probeURL = "http://" + agentAddr + agentUploadPath
+	p.configURL = "http://" + agentAddr + agentConfigPath
+
+	// generate a custom http client for hooking the transport
+	httpClient := cfg.httpClient
+	p.transport = nil
+	if httpClient == nil {
+		p.transport, err = newBFTransport(cfg, protocol, address)
+		if err != nil {
+			return err
 		}
-	case "unix":
-		ddOpts = []dd_profiler.Option{
-			dd_profiler.WithAgentAddr("localhost"),
+		httpClient = &http.Client{Transport: p.transport}
+	}
+
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	exporter := cfg.exporter
+	if exporter == nil {
+		exporter = newAgentExporter(&http.Client{Transport: transport, Timeout: httpClient.Timeout}, p.probeURL)
+	} else {
+		// The DataDog profiler can only upload over HTTP.
+		transport = &exporterTransport{Exporter: exporter}
+	}
+	p.fanout = nil
+	if len(cfg.destinations) > 0 {
+		p.fanout, err = newFanout(cfg, transport, exporter)
+		if err != nil {
+			return err
 		}
-	default:
-		return fmt.Errorf("invalid agent socket protocol: %v [%v]", protocol, cfg.agentSocket)
+		transport, exporter = p.fanout, p.fanout
+	}
+	p.flush = newFlushTransport(transport, exporter)
+	httpClient = &http.Client{Transport: p.flush, Timeout: httpClient.Timeout}
+
+	p.agentAddr = agentAddr
+	p.httpClient = httpClient
+	p.backend = newBackend(cfg.backend)
+
+	if err := p.startCollecting(); err != nil {
+		p.closeFanout(context.Background())
+		p.closeTransport()
+		return err
+	}
+	p.paused = false
+
+	running = p
+	activeConfig = cfg
+
+	if p.transport != nil && p.transport.breaker != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stopSupervisor = cancel
+		p.supervisor.Go(func() {
+			p.supervise(ctx, p.transport.breaker)
+		})
+	}
+
+	if p.transport != nil && cfg.remoteInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stopPoller = cancel
+		p.poller.Go(func() {
+			p.pollRemoteConfig(ctx, cfg.remoteInterval)
+		})
 	}
+	return nil
+}
 
-	mapLabelsToTags := func(m map[string]string) []string {
-		tags := make([]string, 0, len(m))
-		for k, v := range m {
-			tags = append(tags, fmt.Sprintf("%s:%s", k, v))
+// startCollecting starts the backend. Must be called with mu held.
+func (p *Profiler) startCollecting() error {
+	cfg := p.cfg
+	if p.restoreRuntimeRates == nil {
+		p.restoreRuntimeRates = saveRuntimeRates(cfg)
+	}
+	if cfg.memProfileRate > 0 && (slices.Contains(cfg.types, HeapProfile) || slices.Contains(cfg.types, AllocationProfile)) {
+		runtime.MemProfileRate = cfg.memProfileRate
+	}
+	if err := p.backend.start(cfg, p.agentAddr, p.httpClient, p.flush); err != nil {
+		p.restore()
+		return err
+	}
+	return nil
+}
+
+// stopCollecting stops the backend. Must be called with mu held.
+func (p *Profiler) stopCollecting() {
+	p.backend.stop()
+	p.restore()
+}
+
+// Stop stops the profiler. It does nothing if the profiler is not running.
+//
+// The profiles of the current, partial, period are collected and uploaded
+// before Stop returns. If ctx is done before the upload completes, the upload
+// is aborted. In both cases, the returned error wraps ErrProfilesDropped when
+// the final profiles could not be uploaded.
+func (p *Profiler) Stop(ctx context.Context) error {
+	mu.Lock()
+	if running != p {
+		mu.Unlock()
+		return nil
+	}
+	stopSupervisor := p.stopSupervisor
+	stopUpdater := p.stopUpdater
+	stopPoller := p.stopPoller
+	mu.Unlock()
+
+	// The supervisor, the updater and the poller take mu to change the
+	// collection.
+	if stopSupervisor != nil {
+		stopSupervisor()
+		p.supervisor.Wait()
+	}
+	if stopPoller != nil {
+		stopPoller()
+		p.poller.Wait()
+	}
+	if stopUpdater != nil {
+		stopUpdater()
+	}
+	p.updater.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	defer p.publish()
+
+	if running != p {
+		return nil
+	}
+	running = nil
+	activeConfig = nil
+	p.stopSupervisor = nil
+	p.stopUpdater = nil
+	p.stopPoller = nil
+
+	collecting := p.collecting()
+	p.paused = false
+	// The next Start uses the local configuration, with the updates.
+	p.cfg = p.base
+	p.remote = nil
+	p.pending = nil
+	if !collecting {
+		// Nothing was collected since the circuit breaker tripped or the
+		// remote configuration disabled profiling.
+		p.closeFanout(ctx)
+		p.closeTransport()
+		return nil
+	}
+
+	p.flush.beginFlush()
+	stopAbort := context.AfterFunc(ctx, p.flush.abortUploads)
+	p.backend.stop()
+	aborted := !stopAbort()
+	p.flush.abortUploads()
+	p.restore()
+	destinationsErr := p.closeFanout(ctx)
+	p.closeTransport()
+
+	if aborted {
+		return fmt.Errorf("%w: %w", ErrProfilesDropped, context.Cause(ctx))
+	}
+	if err := p.flush.err(); err != nil {
+		return fmt.Errorf("%w: final upload failed: %w", ErrProfilesDropped, err)
+	}
+	if destinationsErr != nil {
+		return fmt.Errorf("%w: %w", ErrProfilesDropped, destinationsErr)
+	}
+	return nil
+}
+
+// closeFanout waits for the uploads to the additional destinations, see
+// fanout.close. Must be called with mu held.
+func (p *Profiler) closeFanout(ctx context.Context) error {
+	if p.fanout == nil {
+		return nil
+	}
+	err := p.fanout.close(ctx)
+	p.fanout = nil
+	return err
+}
+
+// closeTransport stops the replay of the spooled uploads, which are kept for
+// the next Start. Must be called with mu held.
+func (p *Profiler) closeTransport() {
+	if p.transport != nil {
+		p.transport.close()
+	}
+}
+
+// restore restores the runtime state changed by Start.
+func (p *Profiler) restore() {
+	if p.restoreRuntimeRates != nil {
+		p.restoreRuntimeRates()
+		p.restoreRuntimeRates = nil
+	}
+}
+
+// supervise pauses collection when the circuit breaker trips, and resumes it
+// once the agent answers a probe, until ctx is done.
+func (p *Profiler) supervise(ctx context.Context, b *breaker) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.tripped:
+		}
+
+		mu.Lock()
+		if ctx.Err() != nil {
+			mu.Unlock()
+			return
+		}
+		log.Warn().Str("agent_socket", p.cfg.agentSocket).Msg("Blackfire Agent is unreachable or incompatible - pausing profiling")
+		if p.collecting() {
+			// There is no point in waiting for the upload of the current period.
+			p.flush.abortUploads()
+			p.stopCollecting()
+			p.flush.reset()
+		}
+		p.paused = true
+		if p.pending != nil {
+			// There is no upload to wait for anymore.
+			p.reconfigure(p.pending)
+			p.pending = nil
+		}
+		cfg := p.cfg
+		p.publish()
+		mu.Unlock()
+
+		if !p.waitForAgent(ctx, cfg) {
+			return
 		}
-		return tags
-	}
-
-	mapProfTypesToDDProfTypes := func(m []ProfileType) []dd_profiler.ProfileType {
-		dd_prof_types := make([]dd_profiler.ProfileType, 0, len(m))
-		for _, v := range m {
-			switch v {
-			case CPUProfile:
-				dd_prof_types = append(dd_prof_types, dd_profiler.CPUProfile)
-			case HeapProfile:
-				dd_prof_types = append(dd_prof_types, dd_profiler.HeapProfile)
-			case GoroutineProfile:
-				dd_prof_types = append(dd_prof_types, dd_profiler.GoroutineProfile)
-			default:
+
+		mu.Lock()
+		if ctx.Err() != nil {
+			mu.Unlock()
+			return
+		}
+		b.reset()
+		p.paused = false
+		if p.collecting() {
+			if err := p.startCollecting(); err != nil {
+				log.Error().Err(err).Msg("could not resume profiling")
+				p.paused = true
+				p.publish()
+				mu.Unlock()
+				return
 			}
 		}
-		return dd_prof_types
+		p.publish()
+		mu.Unlock()
+		log.Info().Str("agent_socket", cfg.agentSocket).Msg("Blackfire Agent is back - resuming profiling")
 	}
+}
 
-	// generate a custom http client for hooking the transport
-	httpClient := cfg.httpClient
-	if httpClient == nil {
-		httpClient = NewHTTPClient(protocol, address, cfg.serverId, cfg.serverToken)
+// waitForAgent probes the agent with a growing cooldown until it answers. It
+// returns false if ctx is done first.
+func (p *Profiler) waitForAgent(ctx context.Context, cfg *config) bool {
+	cooldown := min(cfg.period, cfg.breakerMaxCooldown)
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(cooldown):
+		}
+
+		err := p.probe(ctx, cfg)
+		if err == nil {
+			return true
+		}
+		cooldown = min(cooldown*2, cfg.breakerMaxCooldown)
+		log.Debug().Err(err).Dur("cooldown", cooldown).Msg("Blackfire Agent probe failed")
 	}
+}
 
-	ddOpts = append(ddOpts,
-		dd_profiler.WithHTTPClient(httpClient),
-		dd_profiler.CPUProfileRate(cfg.cpuProfileRate),
-		dd_profiler.WithPeriod(cfg.period),
-		dd_profiler.CPUDuration(cfg.cpuDuration),
-		dd_profiler.WithTags(mapLabelsToTags(cfg.labels)...),
-		dd_profiler.WithUploadTimeout(cfg.uploadTimeout),
-		dd_profiler.WithProfileTypes(mapProfTypesToDDProfTypes(cfg.types)...),
-	)
-	if err = dd_profiler.Start(ddOpts...); err != nil {
+// probe checks that the agent can be reached and accepts profiles.
+func (p *Profiler) probe(ctx context.Context, cfg *config) error {
+	return probeAgent(ctx, p.transport, p.probeURL, cfg.uploadTimeout)
+}
+
+// probeAgent sends a request to url through t and reports whether an agent
+// accepting profiles answered within timeout.
+func probeAgent(ctx context.Context, t *bfTransport, url string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
 		return err
 	}
-
+	response, err := t.send(req)
+	if err != nil {
+		return err
+	}
+	if response.Body != nil {
+		response.Body.Close()
+	}
 	return nil
 }
 
+// Start starts the default profiler, replacing the one started by a previous
+// call to Start.
+func Start(opts ...Option) error {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	p, err := New(opts...)
+	if err != nil {
+		return err
+	}
+
+	if defaultProfiler != nil {
+		defaultProfiler.Stop(stoppedContext())
+	}
+	defaultProfiler = p
+	defaultStatus.Store(p)
+	return p.Start(context.Background())
+}
+
+// Stop stops the default profiler started by Start. The profiles of the
+// current period are dropped, use StopContext to upload them.
 func Stop() {
-	mu.Lock()
-	defer mu.Unlock()
+	StopContext(stoppedContext())
+}
 
-	activeConfig = nil
-	dd_profiler.Stop()
+// StopContext stops the default profiler started by Start, uploading the
+// profiles of the current period. See Profiler.Stop.
+func StopContext(ctx context.Context) error {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	if defaultProfiler == nil {
+		return nil
+	}
+	err := defaultProfiler.Stop(ctx)
+	defaultProfiler = nil
+	defaultStatus.Store(nil)
+	return err
+}
+
+// stoppedContext returns a context that is already done, to stop a profiler
+// without waiting for the final upload.
+func stoppedContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+// saveRuntimeRates records the memory, block and mutex profiling rates currently
+// set in the runtime and returns a function that puts them back, once cfg was
+// collected.
+//
+// The runtime has no getter for the block profile rate. It is only changed
+// when cfg collects block profiles, and is then reset to 0, the runtime
+// default, which disables block profiling.
+func saveRuntimeRates(cfg *config) func() {
+	memRate := runtime.MemProfileRate
+	mutexFraction := runtime.SetMutexProfileFraction(-1)
+	blockRateSet := slices.Contains(cfg.types, BlockProfile)
+	return func() {
+		runtime.MemProfileRate = memRate
+		if blockRateSet {
+			runtime.SetBlockProfileRate(0)
+		}
+		runtime.SetMutexProfileFraction(mutexFraction)
+	}
 }
@@ -2,12 +2,15 @@ package profiler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -207,3 +210,334 @@ func TestStartStop(t *testing.T) {
 		os.Unsetenv("BLACKFIRE_LOG_LEVEL")
 	})
 }
+
+func TestRuntimeRates(t *testing.T) {
+	m := &mockTransport{}
+	h := &http.Client{Transport: m}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+
+	prev := runtime.SetMutexProfileFraction(3)
+	defer runtime.SetMutexProfileFraction(prev)
+	memRate := runtime.MemProfileRate
+
+	err := Start(period(100*time.Millisecond),
+		WithCPUDuration(100*time.Millisecond),
+		withHTTPClient(h),
+		WithProfileTypes(BlockProfile, MutexProfile, AllocationProfile),
+		WithBlockProfileRate(5),
+		WithMutexProfileFraction(7),
+		WithMemProfileRate(1024))
+	assert.Nil(t, err)
+	assert.Equal(t, 7, runtime.SetMutexProfileFraction(-1))
+	assert.Equal(t, 1024, runtime.MemProfileRate)
+
+	Stop()
+	assert.Equal(t, 3, runtime.SetMutexProfileFraction(-1))
+	assert.Equal(t, memRate, runtime.MemProfileRate)
+}
+
+func TestBlockProfileRateKept(t *testing.T) {
+	m := &mockTransport{}
+	h := &http.Client{Transport: m}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+
+	// Block profiling enabled by the application
+	runtime.SetBlockProfileRate(1)
+	defer runtime.SetBlockProfileRate(0)
+
+	assert.Nil(t, Start(period(100*time.Millisecond), withHTTPClient(h), WithProfileTypes(CPUProfile)))
+	Stop()
+
+	before, _ := runtime.BlockProfile(nil)
+	blockOnChannel()
+	after, _ := runtime.BlockProfile(nil)
+	assert.Greater(t, after, before)
+}
+
+// blockOnChannel blocks for a few milliseconds, from a stack of its own in
+// the block profile.
+func blockOnChannel() {
+	ch := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(ch)
+	}()
+	<-ch
+}
+
+func TestProfilerInstances(t *testing.T) {
+	m := &mockTransport{}
+	h := &http.Client{Transport: m}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+	ctx := context.Background()
+
+	p1, err := New(period(100*time.Millisecond), withHTTPClient(h), WithAppName("p1"))
+	assert.Nil(t, err)
+	p2, err := New(period(100*time.Millisecond), withHTTPClient(h), WithAppName("p2"))
+	assert.Nil(t, err)
+
+	cfg := p1.Config()
+	assert.Equal(t, "p1", cfg.Labels["application_name"])
+	assert.Equal(t, 100*time.Millisecond, cfg.CPUDuration)
+	cfg.Labels["application_name"] = "changed"
+	assert.Equal(t, "p1", p1.Config().Labels["application_name"])
+
+	assert.Nil(t, p1.Start(ctx))
+	assert.ErrorIs(t, p2.Start(ctx), ErrProfilerRunning)
+
+	// Stopping another instance or the default profiler leaves p1 running
+	assert.Nil(t, p2.Stop(ctx))
+	Stop()
+	assert.Equal(t, p1.cfg, activeConfig)
+
+	assert.Nil(t, p1.Stop(ctx))
+	assert.Nil(t, activeConfig)
+
+	assert.Nil(t, p2.Start(ctx))
+	assert.Equal(t, p2.cfg, activeConfig)
+	assert.Nil(t, p2.Stop(ctx))
+}
+
+func TestStopContext(t *testing.T) {
+	t.Run("flush", func(t *testing.T) {
+		uploads := make(chan []*pprof_profile.Profile, 10)
+		m := &mockTransport{}
+		h := &http.Client{Transport: m}
+		m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+			_, profiles := parseConProfReq(t, req)
+			uploads <- profiles
+			return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+		}
+
+		assert.Nil(t, Start(period(time.Minute), withHTTPClient(h)))
+		time.Sleep(100 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.Nil(t, StopContext(ctx))
+		assert.Len(t, uploads, 1)
+		profiles := <-uploads
+		assert.Equal(t, "cpu", profiles[0].SampleType[1].Type)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		m := &mockTransport{}
+		h := &http.Client{Transport: m}
+		m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: 500, Body: http.NoBody}, nil
+		}
+
+		assert.Nil(t, Start(period(time.Minute), withHTTPClient(h)))
+
+		err := StopContext(context.Background())
+		assert.ErrorIs(t, err, ErrProfilesDropped)
+		assert.ErrorContains(t, err, "final upload failed: got 500 response")
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		m := &mockTransport{}
+		h := &http.Client{Transport: m}
+		m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+
+		assert.Nil(t, Start(period(time.Minute), withHTTPClient(h)))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := StopContext(ctx)
+		assert.ErrorIs(t, err, ErrProfilesDropped)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var (
+		lock            sync.Mutex
+		agentUp         bool
+		uploads, probes int
+	)
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if req.Method == http.MethodGet {
+			probes++
+		} else {
+			uploads++
+		}
+		if !agentUp {
+			return &http.Response{StatusCode: 404, Body: http.NoBody}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+	counts := func() (int, int) {
+		lock.Lock()
+		defer lock.Unlock()
+		return uploads, probes
+	}
+
+	p, err := New(period(100*time.Millisecond),
+		WithCPUDuration(100*time.Millisecond),
+		withTransport(m),
+		WithUploadRetries(0),
+		WithCircuitBreaker(2, 200*time.Millisecond))
+	assert.Nil(t, err)
+	paused := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return p.paused
+	}
+	assert.Nil(t, p.Start(context.Background()))
+	defer p.Stop(context.Background())
+
+	assert.Eventually(t, paused, 2*time.Second, 10*time.Millisecond)
+	before, _ := counts()
+	time.Sleep(500 * time.Millisecond)
+	after, probed := counts()
+	assert.Equal(t, before, after)
+	assert.Greater(t, probed, 0)
+
+	lock.Lock()
+	agentUp = true
+	lock.Unlock()
+
+	assert.Eventually(t, func() bool {
+		uploaded, _ := counts()
+		return !paused() && uploaded > after
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestUpdate(t *testing.T) {
+	type upload struct {
+		app  string
+		heap bool
+	}
+	uploads := make(chan upload, 100)
+	m := &mockTransport{}
+	h := &http.Client{Transport: m}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		labels, profiles := parseConProfReq(t, req)
+		u := upload{app: labels["application_name"]}
+		for _, p := range profiles {
+			for _, st := range p.SampleType {
+				u.heap = u.heap || st.Type == "inuse_space"
+			}
+		}
+		uploads <- u
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+
+	assert.ErrorIs(t, Update(WithAppName("none")), ErrProfilerNotStarted)
+
+	p, err := New(period(200*time.Millisecond), withHTTPClient(h), WithAppName("before"))
+	assert.Nil(t, err)
+
+	// Settings used by Start can't be changed
+	var cerr *ConfigError
+	err = p.Update(WithAgentSocket("tcp://127.0.0.1:8307"), WithUploadRetries(5), WithCPUProfileRate(-1))
+	assert.ErrorAs(t, err, &cerr)
+	assert.Len(t, cerr.Errors, 1)
+	assert.ErrorContains(t, err, "CPU profile rate must not be negative")
+	err = p.Update(WithAgentSocket("tcp://127.0.0.1:8307"), WithUploadRetries(5))
+	assert.ErrorAs(t, err, &cerr)
+	assert.Len(t, cerr.Errors, 2)
+	assert.ErrorContains(t, err, "agent socket can't be updated")
+	assert.ErrorContains(t, err, "upload retries can't be updated")
+
+	// A stopped profiler is updated right away
+	assert.Nil(t, p.Update(WithCPUDuration(100*time.Millisecond)))
+	assert.Equal(t, 100*time.Millisecond, p.Config().CPUDuration)
+
+	assert.Nil(t, p.Start(context.Background()))
+	defer p.Stop(context.Background())
+	assert.Equal(t, upload{app: "before"}, <-uploads)
+
+	// A running profiler is updated once the current period is uploaded
+	assert.Nil(t, p.Update(WithAppName("after")))
+	assert.Nil(t, p.Update(WithProfileTypes(CPUProfile, HeapProfile)))
+	assert.Equal(t, "before", p.Config().Labels["application_name"])
+
+	deadline := time.After(5 * time.Second)
+	for {
+		var u upload
+		select {
+		case u = <-uploads:
+		case <-deadline:
+			t.Fatal("the update was not applied")
+		}
+		if u.app == "after" {
+			assert.True(t, u.heap)
+			break
+		}
+		assert.Equal(t, upload{app: "before"}, u)
+	}
+	assert.Equal(t, []ProfileType{CPUProfile, HeapProfile}, p.Config().ProfileTypes)
+	assert.Equal(t, p.cfg, activeConfig)
+}
+
+func TestKillSwitch(t *testing.T) {
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		t.Error("unexpected upload")
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+	h := &http.Client{Transport: m}
+
+	t.Setenv("BLACKFIRE_CONPROF_ENABLED", "false")
+	assert.Nil(t, Start(period(100*time.Millisecond), withHTTPClient(h)))
+	assert.Nil(t, activeConfig)
+	assert.Nil(t, StopContext(context.Background()))
+
+	t.Setenv("BLACKFIRE_CONPROF_ENABLED", "true")
+	assert.Nil(t, Start(period(100*time.Millisecond), withHTTPClient(h), WithSampleRatio(0)))
+	assert.Nil(t, activeConfig)
+	assert.Nil(t, StopContext(context.Background()))
+}
+
+func TestDataDogUploadAttempts(t *testing.T) {
+	if !hasDataDogBackend {
+		t.Skip("built without the DataDog backend")
+	}
+
+	var (
+		mu      sync.Mutex
+		batches = map[int]int{}
+	)
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		b, err := decodeBatch(req)
+		assert.Nil(t, err)
+		mu.Lock()
+		batches[b.Seq]++
+		mu.Unlock()
+		return &http.Response{StatusCode: 503, Body: http.NoBody}, nil
+	}
+	p, err := New(period(100*time.Millisecond),
+		withTransport(m),
+		WithBackend(DataDogBackend),
+		WithUploadRetries(0),
+		WithCircuitBreaker(0, 0))
+	assert.Nil(t, err)
+	assert.Nil(t, p.Start(context.Background()))
+	time.Sleep(time.Second)
+	assert.ErrorIs(t, p.Stop(context.Background()), ErrProfilesDropped)
+
+	// The DataDog profiler doesn't retry the failed uploads
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotEmpty(t, batches)
+	for seq, uploads := range batches {
+		assert.Equal(t, 1, uploads, "batch %d", seq)
+	}
+}
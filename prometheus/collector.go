@@ -0,0 +1,64 @@
+// Package prometheus exposes the self-metrics of the Blackfire continuous
+// profiler as a Prometheus collector. It lives in its own module so that the
+// profiler doesn't depend on the Prometheus client.
+package prometheus
+
+import (
+	profiler "github.com/blackfireio/go-continuous-profiling"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	uploadsDesc = prom.NewDesc(
+		"blackfire_conprof_uploads_total",
+		"Number of profiles successfully uploaded to the Blackfire agent.",
+		nil, nil)
+	failuresDesc = prom.NewDesc(
+		"blackfire_conprof_upload_failures_total",
+		"Number of failed profile uploads, by reason.",
+		[]string{"reason"}, nil)
+	payloadSizeDesc = prom.NewDesc(
+		"blackfire_conprof_upload_payload_bytes",
+		"Size of the profile uploads.",
+		nil, nil)
+	uploadDurationDesc = prom.NewDesc(
+		"blackfire_conprof_upload_duration_seconds",
+		"Duration of the profile uploads, retries included.",
+		nil, nil)
+)
+
+// Collector collects the metrics returned by profiler.Metrics.
+type Collector struct{}
+
+// NewCollector returns a collector to register with prometheus.MustRegister.
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	ch <- uploadsDesc
+	ch <- failuresDesc
+	ch <- payloadSizeDesc
+	ch <- uploadDurationDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	m := profiler.Metrics()
+
+	ch <- prom.MustNewConstMetric(uploadsDesc, prom.CounterValue, float64(m.Uploads))
+	for _, reason := range profiler.FailureReasons {
+		ch <- prom.MustNewConstMetric(failuresDesc, prom.CounterValue, float64(m.Failures[reason]), string(reason))
+	}
+	ch <- histogram(payloadSizeDesc, m.PayloadSize)
+	ch <- histogram(uploadDurationDesc, m.UploadDuration)
+}
+
+func histogram(desc *prom.Desc, h profiler.Histogram) prom.Metric {
+	buckets := make(map[float64]uint64, len(h.Buckets))
+	for _, b := range h.Buckets {
+		buckets[b.UpperBound] = b.Count
+	}
+	return prom.MustNewConstHistogram(desc, h.Count, h.Sum, buckets)
+}
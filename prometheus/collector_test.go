@@ -0,0 +1,27 @@
+package prometheus
+
+import (
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	registry := prom.NewPedanticRegistry()
+	require.Nil(t, registry.Register(NewCollector()))
+
+	families, err := registry.Gather()
+	require.Nil(t, err)
+
+	metrics := map[string]int{}
+	for _, f := range families {
+		metrics[f.GetName()] = len(f.GetMetric())
+	}
+	require.Equal(t, map[string]int{
+		"blackfire_conprof_uploads_total":           1,
+		"blackfire_conprof_upload_failures_total":   6,
+		"blackfire_conprof_upload_payload_bytes":    1,
+		"blackfire_conprof_upload_duration_seconds": 1,
+	}, metrics)
+}
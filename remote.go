@@ -0,0 +1,263 @@
+package profiler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+const agentConfigPath = "/profiling/v1/config"
+
+// RemoteSetting is a setting that the remote configuration served by the
+// agent can change. See WithRemoteConfig and WithPinnedSettings.
+type RemoteSetting int
+
+const (
+	RemoteEnabled RemoteSetting = iota
+	RemoteProfileTypes
+	RemoteCPUDuration
+	RemotePeriod
+	RemoteCPUProfileRate
+)
+
+// remoteSettings are the settings of the remote configuration document. Unset
+// fields keep the local configuration.
+type remoteSettings struct {
+	Enabled        *bool    `json:"enabled,omitempty"`
+	ProfileTypes   []string `json:"profile_types,omitempty"`
+	CPUDuration    string   `json:"cpu_duration,omitempty"`
+	Period         string   `json:"period,omitempty"`
+	CPUProfileRate *int     `json:"cpu_profile_rate,omitempty"`
+}
+
+// remoteDocument is the remote configuration served by the agent. The
+// settings of Applications, by application_name label, override the ones at
+// the top level.
+type remoteDocument struct {
+	remoteSettings
+	Applications map[string]remoteSettings `json:"applications,omitempty"`
+}
+
+// settings returns the settings applying to the application named app.
+func (d *remoteDocument) settings(app string) *remoteSettings {
+	s := d.remoteSettings
+	o, ok := d.Applications[app]
+	if !ok {
+		return &s
+	}
+	if o.Enabled != nil {
+		s.Enabled = o.Enabled
+	}
+	if o.ProfileTypes != nil {
+		s.ProfileTypes = o.ProfileTypes
+	}
+	if o.CPUDuration != "" {
+		s.CPUDuration = o.CPUDuration
+	}
+	if o.Period != "" {
+		s.Period = o.Period
+	}
+	if o.CPUProfileRate != nil {
+		s.CPUProfileRate = o.CPUProfileRate
+	}
+	return &s
+}
+
+// options returns the options applying the settings, except the pinned ones.
+func (s *remoteSettings) options(pinned []RemoteSetting) ([]Option, error) {
+	var opts []Option
+	use := func(setting RemoteSetting) bool {
+		return !slices.Contains(pinned, setting)
+	}
+
+	if s.Enabled != nil && use(RemoteEnabled) {
+		opts = append(opts, withRemoteDisabled(!*s.Enabled))
+	}
+	if s.ProfileTypes != nil && use(RemoteProfileTypes) {
+		types := make([]ProfileType, 0, len(s.ProfileTypes))
+		for _, name := range s.ProfileTypes {
+			t, ok := parseProfileType(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown profile type %q", name)
+			}
+			types = append(types, t)
+		}
+		opts = append(opts, WithProfileTypes(types...))
+	}
+	if s.CPUDuration != "" && use(RemoteCPUDuration) {
+		d, err := parseDuration(s.CPUDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU duration %q", s.CPUDuration)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("CPU duration must be positive (%v)", d)
+		}
+		opts = append(opts, WithCPUDuration(d))
+	}
+	if s.Period != "" && use(RemotePeriod) {
+		d, err := parseDuration(s.Period)
+		if err != nil {
+			return nil, fmt.Errorf("invalid period %q", s.Period)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("period must be positive (%v)", d)
+		}
+		opts = append(opts, period(d))
+	}
+	if s.CPUProfileRate != nil && use(RemoteCPUProfileRate) {
+		opts = append(opts, WithCPUProfileRate(*s.CPUProfileRate))
+	}
+	return opts, nil
+}
+
+func withRemoteDisabled(disabled bool) Option {
+	return func(cfg *config) {
+		cfg.remoteDisabled = disabled
+	}
+}
+
+// sameRemoteSettings reports whether a and b have the same values for the
+// settings that the remote configuration can change.
+func sameRemoteSettings(a, b *config) bool {
+	return a.remoteDisabled == b.remoteDisabled &&
+		slices.Equal(a.types, b.types) &&
+		a.cpuDuration == b.cpuDuration &&
+		a.period == b.period &&
+		a.cpuProfileRate == b.cpuProfileRate
+}
+
+// fetchRemoteDocument gets the remote configuration of the application named
+// app from the agent. It returns nil when the agent has none to serve.
+func fetchRemoteDocument(ctx context.Context, t *bfTransport, configURL, app string, timeout time.Duration) (*remoteDocument, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, configURL+"?"+url.Values{"application_name": {app}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Not through send, which logs the 404 responses of the agents too old
+	// to take profiles.
+	response, err := t.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		log.Debug().Msg("the Blackfire Agent serves no remote configuration")
+		return nil, nil
+	case response.StatusCode == http.StatusNoContent:
+		return nil, nil
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return nil, fmt.Errorf("got %d response", response.StatusCode)
+	}
+
+	var doc remoteDocument
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid remote configuration: %w", err)
+	}
+	return &doc, nil
+}
+
+// pollRemoteConfig fetches the remote configuration every interval, until ctx
+// is done.
+func (p *Profiler) pollRemoteConfig(ctx context.Context, interval time.Duration) {
+	for {
+		p.fetchRemoteConfig(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// fetchRemoteConfig fetches the remote configuration and applies it. The
+// previous remote configuration is kept when the agent can't be reached or
+// serves an invalid one.
+func (p *Profiler) fetchRemoteConfig(ctx context.Context) {
+	mu.Lock()
+	app := p.base.labels["application_name"]
+	timeout := p.base.uploadTimeout
+	mu.Unlock()
+
+	doc, err := fetchRemoteDocument(ctx, p.transport, p.configURL, app, timeout)
+	if err != nil {
+		log.Debug().Err(err).Msg("could not fetch the remote configuration")
+		return
+	}
+	var settings *remoteSettings
+	if doc != nil {
+		settings = doc.settings(app)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if ctx.Err() != nil {
+		return
+	}
+	if err := p.setRemote(settings); err != nil {
+		log.Error().Err(err).Msg("ignoring the remote configuration")
+	}
+}
+
+// setRemote replaces the remote settings and schedules the resulting
+// configuration. Must be called with mu held.
+func (p *Profiler) setRemote(settings *remoteSettings) error {
+	if settings != nil {
+		// Reject the invalid documents as a whole.
+		if _, err := settings.options(nil); err != nil {
+			return err
+		}
+	}
+
+	previous := p.remote
+	p.remote = settings
+	current := p.cfg
+	if p.pending != nil {
+		current = p.pending
+	}
+	// The remote settings are checked like the local ones.
+	cfg, err := p.effective(p.base)
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		p.remote = previous
+		return err
+	}
+	if sameRemoteSettings(cfg, current) {
+		return nil
+	}
+
+	if err := p.schedule(p.base); err != nil {
+		p.remote = previous
+		return err
+	}
+	log.Info().Msg("remote profiler configuration applied")
+	return nil
+}
+
+// effective returns the configuration resulting from the local configuration
+// base and the remote settings. Must be called with mu held.
+func (p *Profiler) effective(base *config) (*config, error) {
+	if p.remote == nil {
+		return base, nil
+	}
+	opts, err := p.remote.options(base.pinned)
+	if err != nil {
+		return nil, err
+	}
+	cfg := base.clone()
+	cfg.apply(opts)
+	return cfg, nil
+}
@@ -0,0 +1,148 @@
+package profiler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteSettings(t *testing.T) {
+	doc := &remoteDocument{
+		remoteSettings: remoteSettings{ProfileTypes: []string{"cpu"}, CPUDuration: "10s"},
+		Applications: map[string]remoteSettings{
+			"app": {ProfileTypes: []string{"cpu", "heap"}, Period: "1m"},
+		},
+	}
+
+	cfg, err := newProfilerConfig(WithPinnedSettings(RemotePeriod))
+	require.Nil(t, err)
+	opts, err := doc.settings("app").options(cfg.pinned)
+	require.Nil(t, err)
+	cfg.apply(opts)
+	require.Equal(t, []ProfileType{CPUProfile, HeapProfile}, cfg.types)
+	require.Equal(t, 10*time.Second, cfg.cpuDuration)
+	require.Equal(t, defaultPeriod, cfg.period)
+
+	opts, err = doc.settings("other").options(nil)
+	require.Nil(t, err)
+	require.Len(t, opts, 2)
+
+	_, err = (&remoteSettings{ProfileTypes: []string{"cpu", "gpu"}}).options(nil)
+	require.ErrorContains(t, err, `unknown profile type "gpu"`)
+
+	// The durations are checked like the local ones
+	_, err = (&remoteSettings{Period: "0s"}).options(nil)
+	require.EqualError(t, err, "period must be positive (0s)")
+	_, err = (&remoteSettings{CPUDuration: "-1s"}).options(nil)
+	require.EqualError(t, err, "CPU duration must be positive (-1s)")
+}
+
+func TestFetchRemoteDocument(t *testing.T) {
+	var logs bytes.Buffer
+	defer func(l zerolog.Logger) { log = l }(log)
+	log = zerolog.New(&logs).Level(zerolog.ErrorLevel)
+
+	status := http.StatusNotFound
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: status, Body: http.NoBody}, nil
+	}
+	cfg, err := newProfilerConfig(withTransport(m))
+	require.Nil(t, err)
+	bt, err := newBFTransport(cfg, "tcp", "127.0.0.1:8307")
+	require.Nil(t, err)
+
+	// An agent without remote configuration is not an error
+	doc, err := fetchRemoteDocument(context.Background(), bt, "http://127.0.0.1:8307"+agentConfigPath, "app", time.Second)
+	require.Nil(t, err)
+	require.Nil(t, doc)
+	require.Empty(t, logs.String())
+
+	status = http.StatusInternalServerError
+	_, err = fetchRemoteDocument(context.Background(), bt, "http://127.0.0.1:8307"+agentConfigPath, "app", time.Second)
+	require.EqualError(t, err, "got 500 response")
+}
+
+func TestRemoteConfig(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		document = `{"profile_types": ["cpu"], "applications": {"app": {"profile_types": ["cpu", "heap"]}}}`
+		apps     []string
+	)
+	setDocument := func(d string) {
+		lock.Lock()
+		defer lock.Unlock()
+		document = d
+	}
+	uploads := make(chan bool, 100)
+
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodGet {
+			lock.Lock()
+			defer lock.Unlock()
+			require.Equal(t, agentConfigPath, req.URL.Path)
+			apps = append(apps, req.URL.Query().Get("application_name"))
+			if document == "" {
+				return &http.Response{StatusCode: 404, Body: http.NoBody}, nil
+			}
+			return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(document))}, nil
+		}
+
+		_, profiles := parseConProfReq(t, req)
+		heap := false
+		for _, p := range profiles {
+			for _, st := range p.SampleType {
+				heap = heap || st.Type == "inuse_space"
+			}
+		}
+		uploads <- heap
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+
+	p, err := New(period(200*time.Millisecond),
+		withTransport(m),
+		WithAppName("app"),
+		WithUploadRetries(0),
+		WithRemoteConfig(50*time.Millisecond))
+	require.Nil(t, err)
+	collecting := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return p.collecting()
+	}
+	require.Nil(t, p.Start(context.Background()))
+	defer p.Stop(context.Background())
+
+	// The settings for the application are applied
+	require.Eventually(t, func() bool {
+		return <-uploads
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, []ProfileType{CPUProfile, HeapProfile}, p.Config().ProfileTypes)
+	lock.Lock()
+	require.Equal(t, "app", apps[0])
+	lock.Unlock()
+
+	// Profiling can be disabled
+	setDocument(`{"enabled": false}`)
+	require.Eventually(t, func() bool { return !collecting() }, 5*time.Second, 10*time.Millisecond)
+	for len(uploads) > 0 {
+		<-uploads
+	}
+	time.Sleep(300 * time.Millisecond)
+	require.Len(t, uploads, 0)
+
+	// Without remote configuration, the local one is used again
+	setDocument("")
+	require.Eventually(t, collecting, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []ProfileType{CPUProfile}, p.Config().ProfileTypes)
+	require.False(t, <-uploads)
+}
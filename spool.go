@@ -0,0 +1,296 @@
+package profiler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSpoolMaxAge is how long a spooled profile is kept before being
+	// discarded.
+	DefaultSpoolMaxAge = 24 * time.Hour
+
+	spoolFileExt = ".profile"
+)
+
+// spool stores on disk the uploads that failed because the agent could not be
+// reached, and replays them oldest first once it answers again.
+type spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	timeout  time.Duration // timeout of each replayed upload
+
+	ctx    context.Context // cancelled by close, aborting the replay
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // tracks the replay goroutine
+
+	mu        sync.Mutex
+	replaying bool
+}
+
+func newSpool(dir string, maxBytes int64, maxAge, timeout time.Duration) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create spool directory: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		timeout:  timeout,
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+// close aborts the replay and waits for it. The requests not replayed yet are
+// kept for the next run.
+func (s *spool) close() {
+	s.mu.Lock()
+	s.cancel()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// store writes the request with the given body to the spool directory.
+// Credentials are not written, they are added again when replaying. Storing
+// the upload of a batch again replaces the previous one.
+func (s *spool) store(req *http.Request, body []byte) error {
+	if int64(len(body)) > s.maxBytes {
+		return fmt.Errorf("profile is larger than the spool (%d bytes)", len(body))
+	}
+
+	r := req.Clone(context.Background())
+	r.Header.Del("Authorization")
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := spoolName(r, body)
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name+spoolFileExt)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.prune()
+	return nil
+}
+
+// files returns the spooled files, oldest first. Must be called with mu held.
+func (s *spool) files() ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	entries = slices.DeleteFunc(entries, func(e os.DirEntry) bool {
+		return e.IsDir() || !strings.HasSuffix(e.Name(), spoolFileExt)
+	})
+	// Names start with zero-padded timestamps, ReadDir sorts them by name.
+	return entries, nil
+}
+
+// prune removes the files older than maxAge, then the oldest files until the
+// spool fits in maxBytes. Must be called with mu held.
+func (s *spool) prune() {
+	entries, err := s.files()
+	if err != nil {
+		log.Error().Err(err).Str("dir", s.dir).Msg("could not list spooled profiles")
+		return
+	}
+
+	type spooled struct {
+		path string
+		size int64
+	}
+	var (
+		kept  []spooled
+		total int64
+	)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(s.dir, e.Name())
+		if time.Since(info.ModTime()) > s.maxAge {
+			log.Debug().Str("file", path).Msg("discarding expired spooled profile")
+			os.Remove(path)
+			continue
+		}
+		kept = append(kept, spooled{path, info.Size()})
+		total += info.Size()
+	}
+
+	for len(kept) > 0 && total > s.maxBytes {
+		log.Debug().Str("file", kept[0].path).Msg("spool is full, discarding oldest spooled profile")
+		os.Remove(kept[0].path)
+		total -= kept[0].size
+		kept = kept[1:]
+	}
+}
+
+// load reads a spooled request back.
+func (s *spool) load(path string) (*http.Request, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.RequestURI = ""
+	req.URL.Scheme = "http"
+	req.URL.Host = req.Host
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return req, nil
+}
+
+// replay sends the spooled requests in the background, oldest first, until
+// the spool is empty or an upload fails again.
+func (s *spool) replay(send func(*http.Request) (*http.Response, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.replaying || s.ctx.Err() != nil {
+		return
+	}
+	s.replaying = true
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			s.replaying = false
+			s.mu.Unlock()
+		}()
+
+		for s.ctx.Err() == nil {
+			s.mu.Lock()
+			s.prune()
+			entries, err := s.files()
+			s.mu.Unlock()
+			if err != nil || len(entries) == 0 {
+				return
+			}
+
+			if !s.replayOne(filepath.Join(s.dir, entries[0].Name()), send) {
+				return
+			}
+		}
+	}()
+}
+
+// replayOne sends one spooled request. It returns false if the agent could not
+// take it, in which case the file is kept for later.
+func (s *spool) replayOne(path string, send func(*http.Request) (*http.Response, error)) bool {
+	req, err := s.load(path)
+	if err != nil {
+		log.Error().Err(err).Str("file", path).Msg("discarding unreadable spooled profile")
+		os.Remove(path)
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	response, err := send(req.WithContext(ctx))
+	if response != nil && response.Body != nil {
+		response.Body.Close()
+	}
+	if temporaryFailure(response, err) {
+		return false
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("file", path).Msg("discarding spooled profile")
+	} else if response.StatusCode < 200 || response.StatusCode > 299 {
+		log.Error().Int("status", response.StatusCode).Str("file", path).Msg("discarding spooled profile")
+	} else {
+		log.Debug().Str("file", path).Msg("replayed spooled profile")
+	}
+	os.Remove(path)
+	return true
+}
+
+// spoolName returns the name of the file spooling the upload r: the start
+// and sequence number of its batch, or the current time if its event can't
+// be read.
+func spoolName(r *http.Request, body []byte) string {
+	r = r.Clone(context.Background())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if reader, err := r.MultipartReader(); err == nil {
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			if part.FormName() != "event" {
+				continue
+			}
+			b := Batch{Labels: map[string]string{}}
+			if data, err := io.ReadAll(part); err == nil && decodeEvent(data, &b) == nil && !b.Start.IsZero() {
+				return fmt.Sprintf("%020d-%010d", b.Start.UnixNano(), b.Seq)
+			}
+			break
+		}
+	}
+	return fmt.Sprintf("%020d", time.Now().UnixNano())
+}
+
+// readBody returns the body of the request, leaving it readable.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, nil
+}
@@ -0,0 +1,226 @@
+package profiler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pprof_profile "github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+)
+
+func newSpoolTestClient(t *testing.T, m *mockTransport, maxBytes int64) (*http.Client, string) {
+	dir := t.TempDir()
+	h := newTestClient(t, m,
+		WithCredentials("id", "token"),
+		WithSpoolDir(dir, maxBytes),
+		WithSpoolMaxAge(time.Hour),
+		WithUploadRetries(0),
+	)
+	return h, dir
+}
+
+func spooledFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestSpool(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		down     = true
+		received []string
+	)
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if down {
+			return nil, errors.New("connect: connection refused")
+		}
+		body, _ := io.ReadAll(req.Body)
+		user, _, _ := req.BasicAuth()
+		received = append(received, user+":"+string(body))
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+	h, dir := newSpoolTestClient(t, m, 1<<20)
+
+	for _, body := range []string{"p1", "p2", "p3"} {
+		_, err := h.Post("http://localhost/profiling/v1/input", "text/plain", strings.NewReader(body))
+		require.NotNil(t, err)
+	}
+
+	files := spooledFiles(t, dir)
+	require.Len(t, files, 3)
+	data, err := os.ReadFile(filepath.Join(dir, files[0]))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "p1")
+	require.NotContains(t, string(data), "Authorization")
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+
+	_, err = h.Post("http://localhost/profiling/v1/input", "text/plain", strings.NewReader("p4"))
+	require.Nil(t, err)
+
+	s := h.Transport.(*bfTransport).spool
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return !s.replaying
+	}, time.Second, 10*time.Millisecond)
+	require.Empty(t, spooledFiles(t, dir))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"id:p4", "id:p1", "id:p2", "id:p3"}, received)
+}
+
+func TestSpoolLimits(t *testing.T) {
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 503, Body: http.NoBody}, nil
+	}
+	h, dir := newSpoolTestClient(t, m, 300)
+	s := h.Transport.(*bfTransport).spool
+
+	for _, body := range []string{"p1", "p2", "p3"} {
+		resp, err := h.Post("http://localhost/profiling/v1/input", "text/plain", strings.NewReader(body))
+		require.Nil(t, err)
+		require.Equal(t, 503, resp.StatusCode)
+	}
+
+	// Each request takes about 120 bytes, only the 2 newest ones fit.
+	files := spooledFiles(t, dir)
+	require.Len(t, files, 2)
+	data, err := os.ReadFile(filepath.Join(dir, files[0]))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "p2")
+
+	old := time.Now().Add(-2 * time.Hour)
+	require.Nil(t, os.Chtimes(filepath.Join(dir, files[0]), old, old))
+	s.mu.Lock()
+	s.prune()
+	s.mu.Unlock()
+	require.Equal(t, files[1:], spooledFiles(t, dir))
+}
+
+func TestSpoolBatches(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		down     = true
+		replayed = make(chan struct{})
+	)
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		isDown := down
+		mu.Unlock()
+		if isDown {
+			return nil, errors.New("connect: connection refused")
+		}
+		if !strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/") {
+			return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+		}
+		// The replay of the batch hangs until the spool is closed
+		close(replayed)
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	h, dir := newSpoolTestClient(t, m, 1<<20)
+	bt := h.Transport.(*bfTransport)
+
+	var data bytes.Buffer
+	prof := &pprof_profile.Profile{SampleType: []*pprof_profile.ValueType{{Type: "samples", Unit: "count"}}}
+	require.Nil(t, prof.Write(&data))
+	b := Batch{
+		Start:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		End:      time.Date(2024, 1, 2, 3, 4, 50, 0, time.UTC),
+		Seq:      1,
+		Profiles: []ProfileData{{Name: "cpu.pprof", Data: data.Bytes()}},
+	}
+	e := newAgentExporter(h, "http://localhost"+agentUploadPath)
+
+	// The DataDog profiler uploads a batch again when the upload fails: it is
+	// spooled once
+	require.NotNil(t, e.Export(context.Background(), b))
+	require.NotNil(t, e.Export(context.Background(), b))
+	require.Equal(t, []string{fmt.Sprintf("%020d-%010d", b.Start.UnixNano(), 1) + spoolFileExt}, spooledFiles(t, dir))
+	require.Equal(t, int64(2), statusOf(bt).Failures)
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	_, err := h.Post("http://localhost/profiling/v1/input", "text/plain", strings.NewReader("p2"))
+	require.Nil(t, err)
+
+	// Closing the spool aborts the replay, the profile is kept for the next
+	// run and the cancelled replay isn't counted as a failure
+	select {
+	case <-replayed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("test timeouted")
+	}
+	bt.close()
+	require.Len(t, spooledFiles(t, dir), 1)
+	st := statusOf(bt)
+	require.Equal(t, int64(2), st.Failures)
+	require.Equal(t, int64(1), st.Uploads)
+}
+
+func TestSpoolReplayAccounting(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		down = true
+	)
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			return &http.Response{StatusCode: 503, Body: http.NoBody}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+	h, dir := newSpoolTestClient(t, m, 1<<20)
+	bt := h.Transport.(*bfTransport)
+
+	for _, body := range []string{"p1", "p2"} {
+		_, err := h.Post("http://localhost/profiling/v1/input", "text/plain", strings.NewReader(body))
+		require.Nil(t, err)
+	}
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	_, err := h.Post("http://localhost/profiling/v1/input", "text/plain", strings.NewReader("p3"))
+	require.Nil(t, err)
+
+	// The replays are counted like the uploads
+	require.Eventually(t, func() bool {
+		return len(spooledFiles(t, dir)) == 0 && statusOf(bt).Uploads == 3
+	}, time.Second, 10*time.Millisecond)
+	bt.close()
+	require.Equal(t, int64(2), statusOf(bt).Failures)
+}
+
+func statusOf(t *bfTransport) ProfilerStatus {
+	var st ProfilerStatus
+	t.stats.fill(&st)
+	return st
+}
@@ -0,0 +1,108 @@
+package profiler
+
+import (
+	"sync"
+	"time"
+)
+
+// ProfilerStatus reports the state of a Profiler and the outcome of its
+// uploads, as returned by Status.
+type ProfilerStatus struct {
+	// Running is true between Start and Stop, and Collecting while profiles
+	// are collected: it is false when the circuit breaker or the remote
+	// configuration paused profiling.
+	Running    bool
+	Collecting bool
+	// Config is the effective configuration.
+	Config Config
+
+	// LastUpload is the time of the last successful upload, LastError the
+	// error of the last failed one, at LastErrorTime.
+	LastUpload    time.Time
+	LastError     error
+	LastErrorTime time.Time
+
+	// Uploads and Failures count the successful and failed uploads since
+	// Start, BytesSent the size of the successful ones.
+	Uploads   int64
+	Failures  int64
+	BytesSent int64
+	// AverageLatency is the average duration of the uploads, retries
+	// included.
+	AverageLatency time.Duration
+}
+
+// uploadStats records the outcome of the uploads made through bfTransport.
+type uploadStats struct {
+	mu            sync.Mutex
+	lastUpload    time.Time
+	lastError     error
+	lastErrorTime time.Time
+	uploads       int64
+	failures      int64
+	bytesSent     int64
+	totalLatency  time.Duration
+}
+
+// record records an upload.
+func (s *uploadStats) record(r uploadResult) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.totalLatency += r.latency
+	if r.err != nil {
+		s.failures++
+		s.lastError = r.err
+		s.lastErrorTime = time.Now()
+		return
+	}
+	s.uploads++
+	s.lastUpload = time.Now()
+	s.bytesSent += r.bytes
+}
+
+// fill copies the statistics to st.
+func (s *uploadStats) fill(st *ProfilerStatus) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st.LastUpload = s.lastUpload
+	st.LastError = s.lastError
+	st.LastErrorTime = s.lastErrorTime
+	st.Uploads = s.uploads
+	st.Failures = s.failures
+	st.BytesSent = s.bytesSent
+	if n := s.uploads + s.failures; n > 0 {
+		st.AverageLatency = s.totalLatency / time.Duration(n)
+	}
+}
+
+// Status returns the state of the profiler and the statistics of its uploads
+// since the last Start. It doesn't wait for Start, Stop or Update.
+func (p *Profiler) Status() ProfilerStatus {
+	state := p.state.Load()
+	st := ProfilerStatus{
+		Running:    state.running,
+		Collecting: state.collecting,
+		Config:     state.config.clone(),
+	}
+	state.stats.fill(&st)
+	return st
+}
+
+// Status returns the status of the default profiler started by Start. See
+// Profiler.Status.
+func Status() ProfilerStatus {
+	p := defaultStatus.Load()
+	if p == nil {
+		return ProfilerStatus{}
+	}
+	return p.Status()
+}
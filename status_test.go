@@ -0,0 +1,109 @@
+package profiler
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadStats(t *testing.T) {
+	s := &uploadStats{}
+	req, err := http.NewRequest(http.MethodPost, "http://agent"+agentUploadPath, http.NoBody)
+	require.Nil(t, err)
+	req.ContentLength = 100
+
+	record := func(s *uploadStats, response *http.Response, err error, latency time.Duration) {
+		if r, ok := newUploadResult(req, response, err, latency); ok {
+			s.record(r)
+		}
+	}
+	record(s, &http.Response{StatusCode: 200}, nil, 10*time.Millisecond)
+	record(s, &http.Response{StatusCode: 200}, nil, 20*time.Millisecond)
+	record(s, &http.Response{StatusCode: 500}, nil, 30*time.Millisecond)
+	record(s, nil, context.Canceled, time.Second)
+
+	var st ProfilerStatus
+	s.fill(&st)
+	require.Equal(t, int64(2), st.Uploads)
+	require.Equal(t, int64(1), st.Failures)
+	require.Equal(t, int64(200), st.BytesSent)
+	require.Equal(t, 20*time.Millisecond, st.AverageLatency)
+	require.EqualError(t, st.LastError, "got 500 response")
+	require.False(t, st.LastUpload.IsZero())
+	require.False(t, st.LastErrorTime.IsZero())
+
+	// A nil uploadStats, as with a custom HTTP client, records nothing
+	var none *uploadStats
+	record(none, &http.Response{StatusCode: 200}, nil, time.Second)
+	st = ProfilerStatus{}
+	none.fill(&st)
+	require.Equal(t, ProfilerStatus{}, st)
+}
+
+func TestStatus(t *testing.T) {
+	var fail atomic.Bool
+	m := &mockTransport{}
+	m.DoRoundTripFunc = func(req *http.Request) (*http.Response, error) {
+		if fail.Load() {
+			return &http.Response{StatusCode: 503, Body: http.NoBody}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}
+
+	p, err := New(period(100*time.Millisecond), withTransport(m), WithUploadRetries(0))
+	require.Nil(t, err)
+	require.False(t, p.Status().Running)
+
+	require.Nil(t, p.Start(context.Background()))
+	defer p.Stop(context.Background())
+
+	require.Eventually(t, func() bool {
+		return p.Status().Uploads > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	st := p.Status()
+	require.True(t, st.Running)
+	require.True(t, st.Collecting)
+	require.Equal(t, p.Config(), st.Config)
+	require.Positive(t, st.BytesSent)
+	require.Positive(t, st.AverageLatency)
+	require.Nil(t, st.LastError)
+
+	fail.Store(true)
+	require.Eventually(t, func() bool {
+		return p.Status().Failures > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.EqualError(t, p.Status().LastError, "got 503 response")
+
+	fail.Store(false)
+	require.Nil(t, p.Stop(context.Background()))
+	st = p.Status()
+	require.False(t, st.Running)
+	require.False(t, st.Collecting)
+	require.Positive(t, st.Uploads)
+}
+
+func TestStatusDuringStart(t *testing.T) {
+	p, err := New(WithAppName("my-app"))
+	require.Nil(t, err)
+
+	// Start and Stop hold the lock while waiting for the agent
+	mu.Lock()
+	defer mu.Unlock()
+	done := make(chan ProfilerStatus)
+	go func() {
+		p.Config()
+		Status()
+		done <- p.Status()
+	}()
+	select {
+	case st := <-done:
+		require.False(t, st.Running)
+		require.Equal(t, "my-app", st.Config.Labels["application_name"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("test timeouted")
+	}
+}
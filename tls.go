@@ -0,0 +1,173 @@
+package profiler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsFiles holds the CA and the client certificate read from the files given
+// through BLACKFIRE_AGENT_CA_FILE, BLACKFIRE_AGENT_CERT_FILE and
+// BLACKFIRE_AGENT_KEY_FILE. They are read again when the files change, so that
+// rotated certificates are used without restarting the process.
+type tlsFiles struct {
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string // the agent certificate is verified for
+
+	mu      sync.Mutex
+	modTime map[string]time.Time
+	pool    *x509.CertPool
+	cert    *tls.Certificate
+}
+
+// changed reports whether one of the files was modified since it was last
+// read. Must be called with mu held.
+func (f *tlsFiles) changed(paths ...string) (bool, error) {
+	changed := false
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		if !info.ModTime().Equal(f.modTime[path]) {
+			f.modTime[path] = info.ModTime()
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// forget makes the next call to changed report the files as modified. Must be
+// called with mu held.
+func (f *tlsFiles) forget(paths ...string) {
+	for _, path := range paths {
+		delete(f.modTime, path)
+	}
+}
+
+// rootCAs returns the CA pool, reloading the CA file if it changed.
+func (f *tlsFiles) rootCAs() (*x509.CertPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	changed, err := f.changed(f.caFile)
+	if err != nil {
+		return nil, err
+	}
+	if !changed && f.pool != nil {
+		return f.pool, nil
+	}
+
+	pem, err := os.ReadFile(f.caFile)
+	if err != nil {
+		f.forget(f.caFile)
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		f.forget(f.caFile)
+		return nil, fmt.Errorf("no certificate found in %s", f.caFile)
+	}
+	f.pool = pool
+	return pool, nil
+}
+
+// clientCertificate returns the client certificate, reloading the certificate
+// and key files if they changed.
+func (f *tlsFiles) clientCertificate() (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	changed, err := f.changed(f.certFile, f.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if !changed && f.cert != nil {
+		return f.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		// The files may be in the middle of a rotation, try again next time.
+		f.forget(f.certFile, f.keyFile)
+		return nil, err
+	}
+	f.cert = &cert
+	return f.cert, nil
+}
+
+// verifyConnection verifies the agent certificate against the CA file, for
+// the agent host name. The server name of cs is empty when the agent is
+// dialed by IP address, it can't be used instead.
+func (f *tlsFiles) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no certificate presented by the agent")
+	}
+	pool, err := f.rootCAs()
+	if err != nil {
+		return err
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       f.serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// newTLSConfig returns the TLS configuration used to connect to the agent at
+// host, combining the one given with WithTLSConfig and the certificate files.
+func newTLSConfig(cfg *config, host string) (*tls.Config, error) {
+	tc := &tls.Config{}
+	if cfg.tlsConfig != nil {
+		tc = cfg.tlsConfig.Clone()
+	}
+	if tc.ServerName == "" {
+		tc.ServerName = host
+	}
+	if cfg.tlsCAFile == "" && cfg.tlsCertFile == "" {
+		return tc, nil
+	}
+
+	files := &tlsFiles{
+		caFile:     cfg.tlsCAFile,
+		certFile:   cfg.tlsCertFile,
+		keyFile:    cfg.tlsKeyFile,
+		serverName: tc.ServerName,
+		modTime:    map[string]time.Time{},
+	}
+
+	if files.certFile != "" {
+		// Fail early on unreadable files rather than on the first upload.
+		if _, err := files.clientCertificate(); err != nil {
+			return nil, fmt.Errorf("could not load the client certificate: %w", err)
+		}
+		tc.Certificates = nil
+		tc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return files.clientCertificate()
+		}
+	}
+
+	if files.caFile != "" {
+		if _, err := files.rootCAs(); err != nil {
+			return nil, fmt.Errorf("could not load the CA certificate: %w", err)
+		}
+		// The default verification uses a fixed pool, the agent certificate
+		// is verified by verifyConnection against the current CA file instead.
+		tc.InsecureSkipVerify = true
+		tc.VerifyConnection = files.verifyConnection
+	}
+
+	return tc, nil
+}
@@ -0,0 +1,184 @@
+package profiler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA
+// when parent is nil, valid for hosts or 127.0.0.1 when none is given.
+func newTestCert(t *testing.T, name string, parent *testCert, hosts ...string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if len(hosts) == 0 {
+		hosts = []string{"127.0.0.1"}
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	require.Nil(t, os.WriteFile(path, data, 0600))
+	require.Nil(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "agent", ca)
+	client := newTestCert(t, "client", ca)
+	rogue := newTestCert(t, "client", newTestCert(t, "rogue ca", nil))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	agent := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/profiling/v1/input", r.URL.Path)
+		w.WriteHeader(200)
+	}))
+	agent.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.cert.Raw}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	agent.StartTLS()
+	defer agent.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	past := time.Now().Add(-time.Minute)
+	writeTestFile(t, caFile, ca.certPEM, past)
+	writeTestFile(t, certFile, rogue.certPEM, past)
+	writeTestFile(t, keyFile, rogue.keyPEM, past)
+
+	t.Setenv("BLACKFIRE_AGENT_CA_FILE", caFile)
+	t.Setenv("BLACKFIRE_AGENT_CERT_FILE", certFile)
+	t.Setenv("BLACKFIRE_AGENT_KEY_FILE", keyFile)
+
+	address := strings.TrimPrefix(agent.URL, "https://")
+	cfg, err := newProfilerConfig(WithUploadRetries(0))
+	require.Nil(t, err)
+	bt, err := newBFTransport(cfg, "https", address)
+	require.Nil(t, err)
+	h := &http.Client{Transport: bt}
+
+	// The agent rejects a certificate from another CA
+	_, err = h.Post("http://"+address+"/profiling/v1/input", "text/plain", strings.NewReader("profile"))
+	require.NotNil(t, err)
+
+	// Rotated certificates are picked up
+	writeTestFile(t, certFile, client.certPEM, time.Now())
+	writeTestFile(t, keyFile, client.keyPEM, time.Now())
+	resp, err := h.Post("http://"+address+"/profiling/v1/input", "text/plain", strings.NewReader("profile"))
+	require.Nil(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	// The agent certificate must be signed by the CA
+	writeTestFile(t, caFile, newTestCert(t, "other ca", nil).certPEM, time.Now().Add(time.Minute))
+	bt.Transport.(*http.Transport).CloseIdleConnections()
+	_, err = h.Post("http://"+address+"/profiling/v1/input", "text/plain", strings.NewReader("profile"))
+	require.ErrorContains(t, err, "certificate signed by unknown authority")
+}
+
+func TestAgentCertificateHost(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "agent", ca, "other.example")
+
+	agent := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	agent.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.cert.Raw}, PrivateKey: server.key}},
+	}
+	agent.StartTLS()
+	defer agent.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeTestFile(t, caFile, ca.certPEM, time.Now())
+	t.Setenv("BLACKFIRE_AGENT_CA_FILE", caFile)
+
+	address := strings.TrimPrefix(agent.URL, "https://")
+	cfg, err := newProfilerConfig(WithUploadRetries(0))
+	require.Nil(t, err)
+	bt, err := newBFTransport(cfg, "https", address)
+	require.Nil(t, err)
+	h := &http.Client{Transport: bt}
+
+	// Signed by the CA, but for another host than the one dialed
+	_, err = h.Post("http://"+address+"/profiling/v1/input", "text/plain", strings.NewReader("profile"))
+	require.ErrorContains(t, err, "cannot validate certificate for 127.0.0.1")
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	t.Setenv("BLACKFIRE_AGENT_CERT_FILE", "/does/not/exist.pem")
+	_, err := newProfilerConfig()
+	require.ErrorContains(t, err, "BLACKFIRE_AGENT_CERT_FILE and BLACKFIRE_AGENT_KEY_FILE must be set together")
+
+	t.Setenv("BLACKFIRE_AGENT_KEY_FILE", "/does/not/exist.pem")
+	cfg, err := newProfilerConfig()
+	require.Nil(t, err)
+	_, err = newBFTransport(cfg, "https", "localhost:8307")
+	require.ErrorContains(t, err, "could not load the client certificate")
+
+	// Unix sockets don't use TLS
+	_, err = newBFTransport(cfg, "unix", "/var/run/blackfire/agent.sock")
+	require.Nil(t, err)
+}
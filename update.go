@@ -0,0 +1,210 @@
+package profiler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// ErrProfilerNotStarted is returned by Update when Start was not called.
+var ErrProfilerNotStarted = errors.New("profiler is not started")
+
+// Update changes the configuration of the profiler. The options are applied
+// on top of the current configuration, and the result is checked as a whole:
+// on error, nothing is changed. Options changing how the agent is reached
+// (agent socket, credentials, TLS, proxy, connection settings, upload timeout
+// and retries, spool and circuit breaker), the backend, the exporter and the
+// destinations can't be updated and are reported in the returned *ConfigError.
+//
+// When the profiler is running, the new configuration is used once the
+// profiles of the current period are uploaded, so that no period is lost.
+// Successive updates made before that are applied together.
+func (p *Profiler) Update(opts ...Option) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	base := p.base.clone()
+	base.apply(opts)
+	return p.schedule(base)
+}
+
+// schedule checks the configuration resulting from the local configuration
+// base and the remote settings, and applies it at the end of the current
+// period. Must be called with mu held.
+func (p *Profiler) schedule(base *config) error {
+	defer p.publish()
+	current := p.cfg
+	if p.pending != nil {
+		current = p.pending
+	}
+	cfg, err := p.effective(base)
+	if err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if err := checkUpdate(current, cfg); err != nil {
+		return err
+	}
+	p.base = base
+
+	if running != p {
+		p.cfg = cfg
+		return nil
+	}
+	if !p.collecting() {
+		// There is no period to wait for.
+		p.pending = nil
+		p.reconfigure(cfg)
+		return nil
+	}
+
+	p.pending = cfg
+	if p.stopUpdater == nil {
+		// Only the uploads completing from now on end the current period.
+		select {
+		case <-p.flush.uploaded:
+		default:
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stopUpdater = cancel
+		p.updater.Go(func() {
+			p.applyAfterUpload(ctx)
+		})
+	}
+	return nil
+}
+
+// applyAfterUpload applies the pending configuration once the next upload
+// completes, unless ctx is done first.
+func (p *Profiler) applyAfterUpload(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-p.flush.uploaded:
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if ctx.Err() != nil {
+		return
+	}
+	p.stopUpdater = nil
+	if p.pending == nil {
+		// Already applied when the circuit breaker paused collection.
+		return
+	}
+	cfg := p.pending
+	p.pending = nil
+	p.reconfigure(cfg)
+	log.Debug().Msg("profiler configuration updated")
+}
+
+// reconfigure replaces the configuration of the running profiler, restarting
+// collection if needed. Must be called with mu held.
+func (p *Profiler) reconfigure(cfg *config) {
+	defer p.publish()
+	previous := p.cfg
+	wasCollecting := p.collecting()
+	p.cfg = cfg
+	activeConfig = cfg
+
+	if wasCollecting {
+		// The period that just ended was uploaded, there is no point in
+		// uploading the few moments collected since.
+		p.flush.abortUploads()
+		p.stopCollecting()
+		p.flush.reset()
+	}
+	if !p.collecting() {
+		return
+	}
+	if err := p.startCollecting(); err != nil {
+		log.Error().Err(err).Msg("could not apply the profiler configuration update")
+		p.cfg = previous
+		activeConfig = previous
+		if !p.collecting() {
+			return
+		}
+		if err := p.startCollecting(); err != nil {
+			log.Error().Err(err).Msg("could not restart profiling")
+		}
+	}
+}
+
+// collecting reports whether the running profiler collects profiles. Must be
+// called with mu held.
+func (p *Profiler) collecting() bool {
+	return !p.paused && p.cfg.collects()
+}
+
+// checkUpdate returns a *ConfigError listing the settings of cfg that differ
+// from the current configuration but are only used by Start.
+func checkUpdate(current, cfg *config) error {
+	fixed := []struct {
+		name    string
+		changed bool
+	}{
+		{"agent socket", current.agentSocket != cfg.agentSocket || current.discovery != cfg.discovery},
+		{"credentials", current.serverId != cfg.serverId || current.serverToken != cfg.serverToken ||
+			reflect.ValueOf(current.credentialsProvider).Pointer() != reflect.ValueOf(cfg.credentialsProvider).Pointer()},
+		{"TLS configuration", current.tlsConfig != cfg.tlsConfig || current.tlsCAFile != cfg.tlsCAFile ||
+			current.tlsCertFile != cfg.tlsCertFile || current.tlsKeyFile != cfg.tlsKeyFile},
+		{"proxy", current.proxy != cfg.proxy},
+		{"connection settings", current.connectTimeout != cfg.connectTimeout || current.keepAlive != cfg.keepAlive ||
+			current.maxIdleConns != cfg.maxIdleConns || current.idleConnTimeout != cfg.idleConnTimeout},
+		{"upload timeout", current.uploadTimeout != cfg.uploadTimeout},
+		{"upload retries", current.uploadRetries != cfg.uploadRetries},
+		{"spool", current.spoolDir != cfg.spoolDir || current.spoolMaxBytes != cfg.spoolMaxBytes ||
+			current.spoolMaxAge != cfg.spoolMaxAge},
+		{"circuit breaker", current.breakerFailures != cfg.breakerFailures || current.breakerMaxCooldown != cfg.breakerMaxCooldown},
+		{"backend", current.backend != cfg.backend},
+		{"exporter", !sameExporter(current.exporter, cfg.exporter)},
+		{"destinations", !slices.Equal(current.destinations, cfg.destinations)},
+	}
+
+	var errs []error
+	for _, f := range fixed {
+		if f.changed {
+			errs = append(errs, fmt.Errorf("%s can't be updated, restart the profiler", f.name))
+		}
+	}
+	if len(errs) > 0 {
+		return &ConfigError{Errors: errs}
+	}
+	return nil
+}
+
+// sameExporter reports whether a and b are the same exporter, without
+// panicking on the exporters that can't be compared, such as an ExporterFunc.
+func sameExporter(a, b Exporter) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	switch {
+	case !va.IsValid() || !vb.IsValid():
+		return va.IsValid() == vb.IsValid()
+	case va.Type() != vb.Type():
+		return false
+	case va.Kind() == reflect.Func:
+		return va.Pointer() == vb.Pointer()
+	case va.Comparable():
+		return va.Equal(vb)
+	default:
+		return false
+	}
+}
+
+// Update changes the configuration of the default profiler started by Start.
+// It returns ErrProfilerNotStarted if there is none. See Profiler.Update.
+func Update(opts ...Option) error {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	if defaultProfiler == nil {
+		return ErrProfilerNotStarted
+	}
+	return defaultProfiler.Update(opts...)
+}